@@ -22,20 +22,84 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 
 	"github.com/enix/san-iscsi-csi/pkg/common"
 	"github.com/enix/san-iscsi-csi/pkg/controller"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog"
 )
 
 var bind = flag.String("bind", fmt.Sprintf("unix:///var/run/%s/csi-controller.sock", common.PluginName), "RPC bind URI (can be a UNIX socket path or any URI)")
+var kubeconfig = flag.String("kubeconfig", "", "Path to a kubeconfig file, used to find the arrays of the storage classes (defaults to the in-cluster configuration)")
+var clusterID = flag.String("cluster-id", "", "ID of the cluster stored in the metadata of the volumes it creates, required by the orphaned volumes reconciler")
+var leaderElectionNamespace = flag.String("leader-election-namespace", "default", "Namespace of the lease electing the controller replica running the reconcilers")
+var orphanReconcileInterval = flag.Duration("orphan-reconcile-interval", 0, "Interval between orphaned volumes detections, disabled if zero")
+var orphanDeletionGracePeriod = flag.Duration("orphan-deletion-grace-period", 0, "Delete orphaned volumes once orphaned for this duration, never deleted if zero")
+var staleMapsReconcileInterval = flag.Duration("stale-maps-reconcile-interval", 0, "Interval between stale volume maps detections, disabled if zero")
+var staleMapsDryRun = flag.Bool("stale-maps-dry-run", true, "Only report stale volume maps instead of unmapping them")
+var fencing = flag.Bool("fencing", false, "Unmap volumes from deleted or out-of-service nodes when publishing them to another node")
+var fencingReleaseReservations = flag.Bool("fencing-release-reservations", false, "Release the SCSI reservations of fenced volumes")
+var fsFreezePort = flag.Int("fsfreeze-port", 0, "Port of the node endpoint freezing filesystems while snapshotting them, disabled if zero")
+var fsFreezeTokenFile = flag.String("fsfreeze-token-file", "", "File containing the token authenticating filesystem freeze requests")
+var fsFreezeCAFile = flag.String("fsfreeze-ca-file", "", "File containing the authorities issuing the certificates of the node filesystem freeze endpoints")
+var rollbackBind = flag.String("rollback-bind", "", "Address of the volume rollback endpoint (e.g. 127.0.0.1:9843), disabled if empty")
+var rollbackTokenFile = flag.String("rollback-token-file", "", "File containing the token authenticating volume rollback requests")
 
 func main() {
 	klog.InitFlags(nil)
 	flag.Set("logtostderr", "true")
 	flag.Parse()
 	klog.Infof("starting SAN iSCSI CSI controller %s", common.Version)
-	controller.New().Start(*bind)
+	c := controller.New()
+
+	if *clusterID != "" {
+		if err := c.SetClusterID(*clusterID); err != nil {
+			klog.Fatal(err)
+		}
+	} else if *orphanReconcileInterval > 0 {
+		klog.Fatal("the orphaned volumes reconciler requires -cluster-id, so that volumes of other clusters are never deleted")
+	}
+
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	c.SetKubernetesClient(kubernetes.NewForConfigOrDie(config))
+	if *orphanReconcileInterval > 0 || *staleMapsReconcileInterval > 0 {
+		go c.RunWhenLeader(*leaderElectionNamespace, func(ctx context.Context) {
+			if *orphanReconcileInterval > 0 {
+				go c.RunOrphanReconciler(ctx, *orphanReconcileInterval, *orphanDeletionGracePeriod)
+			}
+			if *staleMapsReconcileInterval > 0 {
+				go c.RunStaleMapsReconciler(ctx, *staleMapsReconcileInterval, *staleMapsDryRun)
+			}
+		})
+	}
+	if *fencing {
+		c.EnableFencing(*fencingReleaseReservations)
+	}
+	if *fsFreezePort > 0 {
+		token, err := common.ReadToken(*fsFreezeTokenFile)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		authorities, err := common.ReadCertPool(*fsFreezeCAFile)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		c.EnableFsFreeze(*fsFreezePort, token, authorities)
+	}
+	if *rollbackBind != "" {
+		token, err := common.ReadToken(*rollbackTokenFile)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		go c.ServeRollback(*rollbackBind, token)
+	}
+
+	c.Start(*bind)
 }
@@ -22,6 +22,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"syscall"
@@ -33,18 +34,47 @@ import (
 
 var bind = flag.String("bind", fmt.Sprintf("unix:///var/run/%s/csi-node.sock", common.PluginName), "RPC bind URI (can be a UNIX socket path or any URI)")
 var chroot = flag.String("chroot", "", "Chroot into a directory at startup (used when running in a container)")
+var topologySegments = flag.String("topology-segments", "", "Topology segments reported by the node, formatted as \"name=value,name=value\" (e.g. \"site=paris,rack=r1\")")
+var topologyArrays = flag.String("topology-arrays", "", "Arrays whose reachability is reported in the node topology, formatted as \"name=portal,portal;name=portal\"")
+var fsFreezeBind = flag.String("fsfreeze-bind", "", "Address of the endpoint freezing filesystems for the controller while snapshotting them (e.g. :9844), disabled if empty")
+var fsFreezeTokenFile = flag.String("fsfreeze-token-file", "", "File containing the token authenticating filesystem freeze requests")
+var fsFreezeCertFile = flag.String("fsfreeze-tls-cert-file", "", "File containing the certificate served on the filesystem freeze endpoint")
+var fsFreezeKeyFile = flag.String("fsfreeze-tls-key-file", "", "File containing the private key of the filesystem freeze endpoint certificate")
 
 func main() {
 	klog.InitFlags(nil)
 	flag.Set("logtostderr", "true")
 	flag.Parse()
 
+	// the token and certificate files are read before entering the chroot, as they are mounted in the container
+	fsFreezeToken := ""
+	var fsFreezeCertificate tls.Certificate
+	if *fsFreezeBind != "" {
+		var err error
+		if fsFreezeToken, err = common.ReadToken(*fsFreezeTokenFile); err != nil {
+			klog.Fatal(err)
+		}
+		if fsFreezeCertificate, err = tls.LoadX509KeyPair(*fsFreezeCertFile, *fsFreezeKeyFile); err != nil {
+			klog.Fatal(err)
+		}
+	}
+
 	if *chroot != "" {
 		if err := syscall.Chroot(*chroot); err != nil {
 			panic(err)
 		}
 	}
 
+	topology, err := node.ParseTopology(*topologySegments, *topologyArrays)
+	if err != nil {
+		klog.Fatal(err)
+	}
+
 	klog.Infof("starting SAN iSCSI CSI node %s", common.Version)
-	node.New().Start(*bind)
+	n := node.New()
+	n.Topology = topology
+	if *fsFreezeBind != "" {
+		go n.ServeFsFreeze(*fsFreezeBind, fsFreezeToken, fsFreezeCertificate)
+	}
+	n.Start(*bind)
 }
@@ -47,13 +47,33 @@ const (
 	PoolConfigKey             = "pool"
 	TargetIQNConfigKey        = "iqn"
 	PortalsConfigKey          = "portals"
+	VolumePrefixConfigKey     = "volumePrefix"
 	APIAddressConfigKey       = "apiAddress"
+	ArrayNameConfigKey        = "arrayName"
+	PoolsConfigKey            = "pools"
+	PoolPlacementConfigKey    = "poolPlacement"
+	PoolOvercommitConfigKey   = "poolOvercommit"
+	TierAffinityConfigKey     = "tierAffinity"
+	ReadAheadSizeConfigKey    = "readAheadSize"
+	WritePolicyConfigKey      = "writePolicy"
+	ReservationConfigKey      = "scsiReservation"
+	FsFreezeConfigKey         = "fsFreeze"
+	FsFreezeTimeoutConfigKey  = "fsFreezeTimeout"
 	UsernameSecretKey         = "username"
 	PasswordSecretKey         = "password"
+	ChapSecretSecretKey       = "chapSecret"
+	MutualChapSecretSecretKey = "mutualChapSecret"
 	StorageClassAnnotationKey = "storageClass"
-
-	MaximumLUN          = 255
-	VolumeNameMaxLength = 32
+	PVCNameConfigKey          = "csi.storage.k8s.io/pvc/name"
+	PVCNamespaceConfigKey     = "csi.storage.k8s.io/pvc/namespace"
+	PVNameConfigKey           = "csi.storage.k8s.io/pv/name"
+
+	MaximumLUN            = 255
+	VolumeNameMaxLength   = 32
+	VolumePrefixMaxLength = 8
+	DefaultVolumePrefix   = "pvc"
+	DefaultSnapshotPrefix = "snap"
+	DefaultGroupPrefix    = "group"
 )
 
 // Driver contains main resources needed by the driver and references the underlying specific driver
@@ -76,7 +96,12 @@ type WithParameters interface {
 
 // WithVolumeCaps is an interface for structs with volume capabilities
 type WithVolumeCaps interface {
-	GetVolumeCapabilities() *[]*csi.VolumeCapability
+	GetVolumeCapabilities() []*csi.VolumeCapability
+}
+
+// WithVolumeCap is an interface for structs with a single volume capability
+type WithVolumeCap interface {
+	GetVolumeCapability() *csi.VolumeCapability
 }
 
 // NewDriver is a convenience function for creating an abstract driver
@@ -90,6 +115,11 @@ func NewDriver(collectors ...prometheus.Collector) *Driver {
 	return &Driver{exporter: exporter}
 }
 
+// Collector returns the collector of the driver metrics
+func (driver *Driver) Collector() *exporter.Collector {
+	return driver.exporter.Collector
+}
+
 func (driver *Driver) InitServer(unaryServerInterceptors ...grpc.UnaryServerInterceptor) {
 	interceptors := append([]grpc.UnaryServerInterceptor{
 		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
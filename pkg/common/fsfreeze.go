@@ -0,0 +1,40 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package common
+
+import "time"
+
+// Paths of the endpoint served by nodes to freeze and thaw the filesystems of their volumes
+const (
+	FsFreezePath = "/fsfreeze"
+	FsThawPath   = "/fsthaw"
+)
+
+// FsFreezeServerName is the name of the certificate served by the nodes on the freeze endpoint, which is verified
+// by the controller in place of the node addresses, as they are not known when the certificate is issued
+const FsFreezeServerName = "fsfreeze." + PluginName
+
+// Bounds of the time a filesystem may stay frozen before the node thaws it on its own
+const (
+	DefaultFsFreezeTimeout = 10 * time.Second
+	MaxFsFreezeTimeout     = time.Minute
+)
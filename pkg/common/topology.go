@@ -0,0 +1,38 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package common
+
+// TopologyKeyPrefix is the prefix of every topology segment key reported by the driver
+const TopologyKeyPrefix = "topology." + PluginName + "/"
+
+// TopologyKey returns the key of a topology segment
+func TopologyKey(name string) string {
+	return TopologyKeyPrefix + name
+}
+
+// ArrayTopologyKey returns the key of the topology segment reported by nodes which can reach the given array
+func ArrayTopologyKey(arrayName string) string {
+	return TopologyKey("array-" + arrayName)
+}
+
+// ArrayReachableTopologyValue is the value of the topology segment reported by nodes which can reach an array
+const ArrayReachableTopologyValue = "true"
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/enix/dothill-api-go/v2"
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+const (
+	overcommitAllowed   = "allowed"
+	overcommitForbidden = "forbidden"
+	defaultTierAffinity = "no-affinity"
+)
+
+// volumeAttributes lists the values accepted by each volume attribute parameter
+var volumeAttributes = map[string][]string{
+	common.PoolOvercommitConfigKey: {overcommitAllowed, overcommitForbidden},
+	common.TierAffinityConfigKey:   {defaultTierAffinity, "archive", "performance"},
+	common.ReadAheadSizeConfigKey:  {"disabled", "adaptive", "stripe", "512KB", "1MB", "2MB", "4MB", "8MB", "16MB", "32MB"},
+	common.WritePolicyConfigKey:    {"write-back", "write-through"},
+}
+
+// checkVolumeAttributes validates the optional volume attributes given in the parameters
+func checkVolumeAttributes(parameters map[string]string) error {
+	for key, values := range volumeAttributes {
+		if value, ok := parameters[key]; ok && !containsString(values, value) {
+			return status.Errorf(codes.InvalidArgument, "'%s' must be one of %s", key, strings.Join(values, ", "))
+		}
+	}
+	return nil
+}
+
+// createVolume creates a volume with the tier affinity given in the parameters
+func createVolume(client *arrayClient, volumeID string, size string, pool string, parameters map[string]string) error {
+	tierAffinity := parameters[common.TierAffinityConfigKey]
+	if tierAffinity == "" {
+		tierAffinity = defaultTierAffinity
+	}
+
+	_, _, err := client.FormattedRequest("/create/volume/pool/%q/size/%s/tier-affinity/%s/%q", pool, size, tierAffinity, volumeID)
+	return err
+}
+
+// checkPoolOvercommit ensures the pool chosen for a volume honors the over-commit constraint given in the parameters.
+// Virtual pools always allocate capacity on write, and their volumes cannot be thick provisioned: forbidding over-commit
+// only restricts volumes to pools which do not let their volumes add up to more than their capacity.
+func checkPoolOvercommit(client *arrayClient, poolName string, parameters map[string]string) error {
+	constraint := parameters[common.PoolOvercommitConfigKey]
+	if constraint != overcommitForbidden {
+		return nil
+	}
+
+	pool, err := getPool(client, poolName)
+	if err != nil {
+		return err
+	}
+	return checkOvercommitConstraint(pool, constraint)
+}
+
+func checkOvercommitConstraint(pool *dothill.Object, constraint string) error {
+	if constraint == overcommitForbidden && strings.EqualFold(getProperty(pool, "overcommit"), "enabled") {
+		return status.Errorf(codes.FailedPrecondition, "pool %s over-commits its capacity, which is forbidden by the '%s' parameter", getProperty(pool, "name"), common.PoolOvercommitConfigKey)
+	}
+	return nil
+}
+
+// applyVolumeAttributes applies the tier affinity and cache policies given in the parameters to an existing volume,
+// which is required for clones as the array copies volumes with default attributes
+func applyVolumeAttributes(client *arrayClient, volumeID string, parameters map[string]string) error {
+	if tierAffinity := parameters[common.TierAffinityConfigKey]; tierAffinity != "" {
+		klog.V(2).Infof("setting tier affinity of volume %s to %s", volumeID, tierAffinity)
+		if _, _, err := client.FormattedRequest("/set/volume/tier-affinity/%s/%q", tierAffinity, volumeID); err != nil {
+			return err
+		}
+	}
+
+	cacheParameters := ""
+	if writePolicy := parameters[common.WritePolicyConfigKey]; writePolicy != "" {
+		cacheParameters += fmt.Sprintf("/write-policy/%s", writePolicy)
+	}
+	if readAheadSize := parameters[common.ReadAheadSizeConfigKey]; readAheadSize != "" {
+		cacheParameters += fmt.Sprintf("/read-ahead-size/%s", readAheadSize)
+	}
+	if cacheParameters != "" {
+		klog.V(2).Infof("setting cache parameters of volume %s to %s", volumeID, cacheParameters)
+		if _, _, err := client.FormattedRequest("/set/volume-cache-parameters%s/%q", cacheParameters, volumeID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,29 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_checkVolumeAttributes(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(checkVolumeAttributes(map[string]string{}))
+	assert.Nil(checkVolumeAttributes(map[string]string{"poolOvercommit": "forbidden", "tierAffinity": "performance", "readAheadSize": "1MB", "writePolicy": "write-back"}))
+	assert.Error(checkVolumeAttributes(map[string]string{"tierAffinity": "fast"}))
+	assert.Error(checkVolumeAttributes(map[string]string{"readAheadSize": "3MB"}))
+}
+
+func Test_checkOvercommitConstraint(t *testing.T) {
+	assert := assert.New(t)
+
+	overcommitting := newTestObject("pools", map[string]string{"name": "A", "overcommit": "Enabled"})
+	committed := newTestObject("pools", map[string]string{"name": "B", "overcommit": "Disabled"})
+
+	assert.Nil(checkOvercommitConstraint(&overcommitting, ""), "over-commit should be allowed by default")
+	assert.Nil(checkOvercommitConstraint(&overcommitting, overcommitAllowed))
+	assert.Nil(checkOvercommitConstraint(&committed, overcommitAllowed))
+	assert.Error(checkOvercommitConstraint(&overcommitting, overcommitForbidden))
+	assert.Nil(checkOvercommitConstraint(&committed, overcommitForbidden))
+}
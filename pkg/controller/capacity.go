@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/enix/dothill-api-go/v2"
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// GetCapacity returns the available capacity of the emptiest storage pool, since a volume cannot span several pools
+func (controller *Controller) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	poolNames := getPoolNames(req.GetParameters())
+	if len(poolNames) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot get capacity without the '%s' or '%s' parameter", common.PoolConfigKey, common.PoolsConfigKey)
+	}
+
+	response := &csi.GetCapacityResponse{}
+	for _, poolName := range poolNames {
+		pool, err := controller.findPool(ctx, poolName, req.GetParameters())
+		if err != nil {
+			return nil, err
+		}
+
+		availableSpace, err := getPoolAvailableSpace(pool)
+		if err != nil {
+			return nil, err
+		}
+		if availableSpace > response.AvailableCapacity {
+			response.AvailableCapacity = availableSpace
+		}
+		klog.V(2).Infof("pool %s has %d bytes available", poolName, availableSpace)
+
+		if maximumBlocks, err := strconv.ParseInt(getProperty(pool, "maximum-size-numeric"), 10, 64); err == nil {
+			maximumSize := maximumBlocks * getPoolBlocksize(pool)
+			if response.MaximumVolumeSize == nil || maximumSize > response.MaximumVolumeSize.Value {
+				response.MaximumVolumeSize = &wrappers.Int64Value{Value: maximumSize}
+			}
+		} else {
+			klog.V(4).Infof("firmware does not report the maximum volume size of pool %s", poolName)
+		}
+	}
+
+	return response, nil
+}
+
+// findPool looks for the pool on the array of the provisioner secret referenced by the storage class parameters,
+// or on the arrays of every storage class using the pool when the secret name is templated
+func (controller *Controller) findPool(ctx context.Context, name string, parameters map[string]string) (*dothill.Object, error) {
+	if controller.kubeClient == nil {
+		return nil, status.Error(codes.FailedPrecondition, "the controller has no access to the Kubernetes API, cannot find the array of the storage class")
+	}
+
+	client, err := controller.getProvisionerSecretClient(ctx, parameters)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not log in the array of the storage class: %v", err)
+	} else if client != nil {
+		return getPool(client, name)
+	}
+
+	arrays, err := controller.getStorageClassArrays(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, array := range arrays {
+		if !containsString(array.pools, name) {
+			continue
+		}
+
+		pool, err := getPool(array.client, name)
+		if status.Code(err) == codes.NotFound {
+			continue
+		}
+		return pool, err
+	}
+
+	return nil, status.Errorf(codes.NotFound, "pool %s not found", name)
+}
+
+func getPool(client *arrayClient, name string) (*dothill.Object, error) {
+	response, _, err := client.FormattedRequest("/show/pools/%q", name)
+	if err != nil {
+		return nil, err
+	}
+
+	for index := range response.Objects {
+		object := &response.Objects[index]
+		if object.Name == "pools" && getProperty(object, "name") == name {
+			return object, nil
+		}
+	}
+
+	return nil, status.Errorf(codes.NotFound, "pool %s not found", name)
+}
+
+func getPoolBlocksize(pool *dothill.Object) int64 {
+	blocksize, err := strconv.ParseInt(getProperty(pool, "blocksize"), 10, 64)
+	if err != nil || blocksize == 0 {
+		return 512
+	}
+	return blocksize
+}
+
+func getPoolAvailableSpace(pool *dothill.Object) (int64, error) {
+	availableBlocks, err := strconv.ParseInt(getProperty(pool, "total-avail-numeric"), 10, 64)
+	if err != nil {
+		return 0, status.Errorf(codes.Internal, "could not parse available capacity of pool %s: %v", getProperty(pool, "name"), err)
+	}
+
+	return availableBlocks * getPoolBlocksize(pool), nil
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/enix/dothill-api-go/v2"
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// redactedSecret replaces secrets in the logged API endpoints
+const redactedSecret = "<hidden>"
+
+// chapRecord holds the CHAP settings of an initiator on the array
+type chapRecord struct {
+	secret       string
+	mutualName   string
+	mutualSecret string
+}
+
+// chapRecordCache remembers the hashes of the CHAP records configured on arrays which do not show their secrets
+type chapRecordCache struct {
+	mutex  sync.Mutex
+	hashes map[string]string
+}
+
+func newChapRecordCache() *chapRecordCache {
+	return &chapRecordCache{hashes: map[string]string{}}
+}
+
+func (record chapRecord) hash() string {
+	hash := sha256.Sum256([]byte(strconv.Quote(record.secret) + strconv.Quote(record.mutualName) + strconv.Quote(record.mutualSecret)))
+	return hex.EncodeToString(hash[:])
+}
+
+// ensureChapRecord registers the CHAP credentials found in secrets for the given initiator, so that the array
+// requires them when the initiator logs in. Mutual CHAP is configured when a target secret is given.
+// The record is only created or updated when it is missing or differs from the secrets.
+func (controller *Controller) ensureChapRecord(client *arrayClient, initiatorName string, targetIQN string, secrets map[string]string) error {
+	record := chapRecord{secret: secrets[common.ChapSecretSecretKey]}
+	if record.secret == "" {
+		return nil
+	}
+
+	parameters := fmt.Sprintf("/name/%q/secret/%s", initiatorName, quoteSecret(record.secret))
+	redactedParameters := fmt.Sprintf("/name/%q/secret/%s", initiatorName, redactedSecret)
+	if record.mutualSecret = secrets[common.MutualChapSecretSecretKey]; record.mutualSecret != "" {
+		if targetIQN == "" {
+			return status.Errorf(codes.InvalidArgument, "mutual CHAP requires the '%s' parameter", common.TargetIQNConfigKey)
+		}
+		record.mutualName = targetIQN
+		parameters += fmt.Sprintf("/mutual-name/%q/mutual-secret/%s", targetIQN, quoteSecret(record.mutualSecret))
+		redactedParameters += fmt.Sprintf("/mutual-name/%q/mutual-secret/%s", targetIQN, redactedSecret)
+	}
+
+	existing, err := getChapRecord(client, initiatorName)
+	if err != nil {
+		return err
+	}
+
+	cacheKey := client.Addr + "/" + initiatorName
+	action := "create"
+	if existing != nil {
+		action = "set"
+		if existing.secret != "" && *existing == record {
+			return nil
+		}
+		if existing.secret == "" && controller.chapRecords.get(cacheKey) == record.hash() {
+			return nil
+		}
+	}
+
+	klog.Infof("configuring CHAP record for initiator %s", initiatorName)
+	endpoint := fmt.Sprintf("/%s/chap-record%s", action, parameters)
+	redactedEndpoint := fmt.Sprintf("/%s/chap-record%s", action, redactedParameters)
+	if err = sendSecretRequest(client, endpoint, redactedEndpoint); err != nil {
+		return status.Errorf(codes.Internal, "could not configure CHAP record for initiator %s: %v", initiatorName, err)
+	}
+
+	controller.chapRecords.set(cacheKey, record.hash())
+	return nil
+}
+
+func (cache *chapRecordCache) get(key string) string {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.hashes[key]
+}
+
+func (cache *chapRecordCache) set(key string, hash string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.hashes[key] = hash
+}
+
+// getChapRecord returns the CHAP record of the initiator, with empty secrets if the array does not show them,
+// or nil if there is none
+func getChapRecord(client *arrayClient, initiatorName string) (*chapRecord, error) {
+	response, _, err := client.FormattedRequest("/show/chap-records/name/%q", initiatorName)
+	if err != nil {
+		return nil, err
+	}
+
+	for index := range response.Objects {
+		object := &response.Objects[index]
+		if object.Name == "chap-records" && getProperty(object, "initiator-name") == initiatorName {
+			return &chapRecord{
+				secret:       getProperty(object, "initiator-secret"),
+				mutualName:   getProperty(object, "oname"),
+				mutualSecret: getProperty(object, "osecret"),
+			}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// quoteSecret escapes the secret since, unlike object names, it may contain any printable character
+func quoteSecret(secret string) string {
+	return url.PathEscape(strconv.Quote(secret))
+}
+
+// sendSecretRequest sends a request whose endpoint contains secrets, logging the redacted endpoint instead, as the API
+// client logs the endpoint of every request. It logs in with its own session, since the one of the client is private,
+// and logs it out afterwards so that sessions do not pile up on the array.
+func sendSecretRequest(client *arrayClient, endpoint string, redactedEndpoint string) error {
+	hash := md5.Sum([]byte(fmt.Sprintf("%s_%s", client.Username, client.Password)))
+	response, err := sendRawRequest(client, "", fmt.Sprintf("/login/%x", hash))
+	if err != nil {
+		return fmt.Errorf("login failed: %v", err)
+	}
+	sessionKey := response.ObjectsMap["status"].PropertiesMap["response"].Data
+	defer func() {
+		if _, err := sendRawRequest(client, sessionKey, "/exit"); err != nil {
+			klog.Warningf("could not log out of the session used to send secrets: %v", err)
+		}
+	}()
+
+	klog.Infof("-> GET %s", redactedEndpoint)
+	response, err = sendRawRequest(client, sessionKey, endpoint)
+	if err != nil {
+		return err
+	}
+
+	responseStatus := response.GetStatus()
+	klog.Infof("<- [%d %s] %s", responseStatus.ReturnCode, responseStatus.ResponseType, responseStatus.Response)
+	return nil
+}
+
+func sendRawRequest(client *arrayClient, sessionKey string, endpoint string) (*dothill.Response, error) {
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s/api%s", client.Addr, endpoint), nil)
+	if err != nil {
+		return nil, err
+	}
+	if sessionKey != "" {
+		request.Header.Set("sessionKey", sessionKey)
+	}
+
+	httpResponse, err := client.HTTPClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode >= 400 {
+		return nil, fmt.Errorf("API returned unexpected HTTP status %d", httpResponse.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := dothill.NewResponse(data)
+	if err != nil {
+		return nil, err
+	}
+	statusObject, ok := response.ObjectsMap["status"]
+	if !ok {
+		return nil, fmt.Errorf("API response has no status")
+	}
+	for _, name := range []string{"response-type", "response-type-numeric", "response", "return-code", "time-stamp-numeric"} {
+		if _, ok := statusObject.PropertiesMap[name]; !ok {
+			return nil, fmt.Errorf("API response status has no %s", name)
+		}
+	}
+	if responseStatus := response.GetStatus(); responseStatus.ResponseTypeNumeric != 0 {
+		return nil, fmt.Errorf("Dothill API returned non-zero code %d (%s)", responseStatus.ReturnCode, responseStatus.Response)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/enix/dothill-api-go/v2"
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"github.com/stretchr/testify/assert"
+)
+
+const testStatus = `<OBJECT basetype="status" name="status"><PROPERTY name="response-type">Success</PROPERTY>` +
+	`<PROPERTY name="response-type-numeric">0</PROPERTY><PROPERTY name="response">%s</PROPERTY>` +
+	`<PROPERTY name="return-code">0</PROPERTY><PROPERTY name="time-stamp-numeric">0</PROPERTY></OBJECT>`
+
+// newChapTestServer serves the CHAP record of the initiator, showing its secret unless hidden, and records its updates
+// along with the number of sessions left open
+func newChapTestServer(record **chapRecord, hidden *bool, updates *[]string, sessions *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/api")
+		objects := ""
+		switch {
+		case strings.HasPrefix(path, "/login/"):
+			*sessions++
+			fmt.Fprintf(w, "<RESPONSE>"+testStatus+"</RESPONSE>", "session")
+			return
+		case path == "/exit":
+			*sessions--
+		case strings.HasPrefix(path, "/show/chap-records/") && *record != nil:
+			secret := (*record).secret
+			if *hidden {
+				secret = ""
+			}
+			objects = fmt.Sprintf(`<OBJECT basetype="chap-records" name="chap-records"><PROPERTY name="initiator-name">iqn.node</PROPERTY>`+
+				`<PROPERTY name="initiator-secret">%s</PROPERTY></OBJECT>`, secret)
+		case strings.HasPrefix(path, "/create/chap-record/"), strings.HasPrefix(path, "/set/chap-record/"):
+			if r.Header.Get("sessionKey") != "session" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			*updates = append(*updates, path)
+		}
+		fmt.Fprintf(w, "<RESPONSE>"+objects+testStatus+"</RESPONSE>", "Command completed successfully.")
+	}))
+}
+
+func TestController_ensureChapRecord(t *testing.T) {
+	assert := assert.New(t)
+
+	controller := &Controller{chapRecords: newChapRecordCache()}
+	secrets := map[string]string{common.ChapSecretSecretKey: "s3cr3t/pass"}
+	var record *chapRecord
+	var hidden bool
+	var updates []string
+	var sessions int
+	server := newChapTestServer(&record, &hidden, &updates, &sessions)
+	defer server.Close()
+	client := newArrayClient(dothill.NewClient())
+	client.Addr = server.URL
+
+	ensure := func(existing *chapRecord, hide bool) []string {
+		record, hidden, updates = existing, hide, []string{}
+		assert.NoError(controller.ensureChapRecord(client, "iqn.node", "", secrets))
+		return updates
+	}
+
+	assert.Equal([]string{`/create/chap-record/name/"iqn.node"/secret/"s3cr3t/pass"`}, ensure(nil, false), "missing records should be created")
+	assert.Empty(ensure(&chapRecord{secret: "s3cr3t/pass"}, false), "unchanged records should be left alone")
+	assert.Len(ensure(&chapRecord{secret: "old"}, false), 1, "changed records should be updated")
+	assert.Empty(ensure(&chapRecord{secret: "old"}, true), "hidden records configured by the controller should be left alone")
+
+	secrets[common.ChapSecretSecretKey] = "n3w"
+	assert.Equal([]string{`/set/chap-record/name/"iqn.node"/secret/"n3w"`}, ensure(&chapRecord{secret: "old"}, true))
+	assert.Equal(1, sessions, "sessions opened to send secrets should be logged out")
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/enix/dothill-api-go/v2"
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+type clientContextKey struct{}
+
+// arrayClient serializes the requests sent through a pooled dothill client: calls for different volumes run
+// concurrently, while the API client reads and renews its session key without any synchronization
+type arrayClient struct {
+	*dothill.Client
+	mutex *sync.Mutex
+}
+
+func newArrayClient(client *dothill.Client) *arrayClient {
+	return &arrayClient{Client: client, mutex: &sync.Mutex{}}
+}
+
+func (client *arrayClient) Login() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.Client.Login()
+}
+
+func (client *arrayClient) Request(endpoint string) (*dothill.Response, *dothill.ResponseStatus, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.Client.Request(endpoint)
+}
+
+func (client *arrayClient) FormattedRequest(endpointFormat string, opts ...interface{}) (*dothill.Response, *dothill.ResponseStatus, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.Client.FormattedRequest(endpointFormat, opts...)
+}
+
+func (client *arrayClient) CreateHost(name, iqn string) (*dothill.Response, *dothill.ResponseStatus, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.Client.CreateHost(name, iqn)
+}
+
+func (client *arrayClient) MapVolume(name, host, access string, lun int) (*dothill.Response, *dothill.ResponseStatus, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.Client.MapVolume(name, host, access, lun)
+}
+
+func (client *arrayClient) UnmapVolume(name, host string) (*dothill.Response, *dothill.ResponseStatus, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.Client.UnmapVolume(name, host)
+}
+
+func (client *arrayClient) ShowVolumes(volumes ...string) (*dothill.Response, *dothill.ResponseStatus, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.Client.ShowVolumes(volumes...)
+}
+
+func (client *arrayClient) ExpandVolume(name, size string) (*dothill.Response, *dothill.ResponseStatus, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.Client.ExpandVolume(name, size)
+}
+
+func (client *arrayClient) DeleteVolume(name string) (*dothill.Response, *dothill.ResponseStatus, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.Client.DeleteVolume(name)
+}
+
+func (client *arrayClient) CopyVolume(sourceName string, destinationName string, pool string) (*dothill.Response, *dothill.ResponseStatus, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.Client.CopyVolume(sourceName, destinationName, pool)
+}
+
+func (client *arrayClient) ShowHostMaps(host string) ([]dothill.Volume, *dothill.ResponseStatus, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.Client.ShowHostMaps(host)
+}
+
+func (client *arrayClient) ShowSnapshots(names ...string) (*dothill.Response, *dothill.ResponseStatus, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.Client.ShowSnapshots(names...)
+}
+
+func (client *arrayClient) CreateSnapshot(name string, snapshotName string) (*dothill.Response, *dothill.ResponseStatus, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.Client.CreateSnapshot(name, snapshotName)
+}
+
+func (client *arrayClient) DeleteSnapshot(names ...string) (*dothill.Response, *dothill.ResponseStatus, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.Client.DeleteSnapshot(names...)
+}
+
+// clientPool holds one authenticated dothill client per API address and username,
+// so that storage classes pointing to different arrays can be served concurrently
+type clientPool struct {
+	mutex     sync.Mutex
+	clients   map[string]*arrayClient
+	logins    *keyedLocks
+	collector *dothill.Collector
+}
+
+func newClientPool(collector *dothill.Collector) *clientPool {
+	return &clientPool{
+		clients:   map[string]*arrayClient{},
+		logins:    newKeyedLocks(),
+		collector: collector,
+	}
+}
+
+// Get returns the client matching the given credentials, logging in if it does not exist yet.
+// Logins are serialized per API address and username only, so that an unreachable array does not block the others.
+func (pool *clientPool) Get(credentials map[string]string) (*arrayClient, error) {
+	username := string(credentials[common.UsernameSecretKey])
+	password := string(credentials[common.PasswordSecretKey])
+	apiAddr := string(credentials[common.APIAddressConfigKey])
+
+	if len(apiAddr) == 0 || len(username) == 0 || len(password) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one field is missing in credentials secret")
+	}
+
+	klog.Infof("using dothill API at address %s", apiAddr)
+	key := fmt.Sprintf("%s/%s", apiAddr, username)
+	pool.logins.Lock(key)
+	defer pool.logins.Unlock(key)
+
+	pool.mutex.Lock()
+	client, ok := pool.clients[key]
+	pool.mutex.Unlock()
+	if ok && client.Password == password {
+		klog.V(2).Info("dothill client is already configured for this API, skipping login")
+		return client, nil
+	}
+
+	client = newArrayClient(dothill.NewClient())
+	client.Collector = pool.collector
+	client.Username = username
+	client.Password = password
+	client.Addr = apiAddr
+	klog.Infof("login into %q as user %q", client.Addr, client.Username)
+	if err := client.Login(); err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	klog.Info("login was successful")
+	pool.mutex.Lock()
+	pool.clients[key] = client
+	pool.mutex.Unlock()
+	return client, nil
+}
+
+// getClient returns the client configured for the current call
+func getClient(ctx context.Context) *arrayClient {
+	return ctx.Value(clientContextKey{}).(*arrayClient)
+}
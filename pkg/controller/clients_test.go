@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/enix/dothill-api-go/v2"
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_clientPool_Get(t *testing.T) {
+	assert := assert.New(t)
+
+	pool := newClientPool(nil)
+	client := newArrayClient(&dothill.Client{Addr: "https://fast", Username: "user", Password: "pass"})
+	pool.clients["https://fast/user"] = client
+
+	// a login in progress on another array must not block the pool
+	pool.logins.Lock("https://slow/user")
+	defer pool.logins.Unlock("https://slow/user")
+
+	result := make(chan *arrayClient)
+	go func() {
+		found, _ := pool.Get(map[string]string{
+			common.APIAddressConfigKey: "https://fast",
+			common.UsernameSecretKey:   "user",
+			common.PasswordSecretKey:   "pass",
+		})
+		result <- found
+	}()
+
+	select {
+	case found := <-result:
+		assert.Equal(client, found)
+	case <-time.After(time.Second):
+		t.Fatal("getting a client was blocked by the login to another array")
+	}
+}
+
+func Test_arrayClient_FormattedRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	var running, overlaps int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		defer atomic.AddInt32(&running, -1)
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprintf(w, "<RESPONSE>"+testStatus+"</RESPONSE>", "session")
+	}))
+	defer server.Close()
+	client := newArrayClient(dothill.NewClient())
+	client.Addr = server.URL
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, err := client.FormattedRequest("/show/volumes/%q", fmt.Sprint(i))
+			assert.NoError(err)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Zero(overlaps, "requests sharing a client session should not be sent concurrently")
+}
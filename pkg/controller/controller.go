@@ -24,7 +24,7 @@ package controller
 import (
 	"context"
 	"errors"
-	"sync"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/enix/dothill-api-go/v2"
@@ -32,6 +32,8 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 )
 
@@ -43,6 +45,7 @@ const (
 	volumeHasSnapshot             = -10183
 	snapshotNotFoundErrorCode     = -10050
 	snapshotAlreadyExists         = -10186
+	volumeShowNotFoundErrorCode   = -10058
 )
 
 var volumeCapabilities = []*csi.VolumeCapability{
@@ -54,14 +57,50 @@ var volumeCapabilities = []*csi.VolumeCapability{
 			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
 		},
 	},
+	{
+		AccessType: &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	},
+	{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		},
+	},
+	{
+		AccessType: &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		},
+	},
 }
 
-var csiMutexes = map[string]*sync.Mutex{
-	"/csi.v1.Controller/CreateVolume":              {},
-	"/csi.v1.Controller/ControllerPublishVolume":   {},
-	"/csi.v1.Controller/DeleteVolume":              {},
-	"/csi.v1.Controller/ControllerUnpublishVolume": {},
-	"/csi.v1.Controller/ControllerExpandVolume":    {},
+// volumeLockedMethods returns, for methods that must not run concurrently on the same volume, the ID of the volume they work on
+var volumeLockedMethods = map[string]func(req interface{}) string{
+	"/csi.v1.Controller/CreateVolume": func(req interface{}) string {
+		createVolumeRequest := req.(*csi.CreateVolumeRequest)
+		return getVolumeID(createVolumeRequest.GetName(), createVolumeRequest.GetParameters()[common.VolumePrefixConfigKey])
+	},
+	"/csi.v1.Controller/ControllerPublishVolume": func(req interface{}) string {
+		return req.(*csi.ControllerPublishVolumeRequest).GetVolumeId()
+	},
+	"/csi.v1.Controller/DeleteVolume": func(req interface{}) string {
+		return req.(*csi.DeleteVolumeRequest).GetVolumeId()
+	},
+	"/csi.v1.Controller/ControllerUnpublishVolume": func(req interface{}) string {
+		return req.(*csi.ControllerUnpublishVolumeRequest).GetVolumeId()
+	},
+	"/csi.v1.Controller/ControllerExpandVolume": func(req interface{}) string {
+		return req.(*csi.ControllerExpandVolumeRequest).GetVolumeId()
+	},
 }
 
 var nonAuthenticatedMethods = []string{
@@ -69,16 +108,44 @@ var nonAuthenticatedMethods = []string{
 	"/csi.v1.Controller/ListVolumes",
 	"/csi.v1.Controller/GetCapacity",
 	"/csi.v1.Controller/ControllerGetVolume",
+	"/csi.v1.GroupController/GroupControllerGetCapabilities",
 	"/csi.v1.Identity/Probe",
 	"/csi.v1.Identity/GetPluginInfo",
 	"/csi.v1.Identity/GetPluginCapabilities",
 }
 
-// Controller is the implementation of csi.ControllerServer
+// selfValidatedMethods report unsupported parameters and capabilities in their response rather than as an error
+var selfValidatedMethods = []string{
+	"/csi.v1.Controller/ValidateVolumeCapabilities",
+}
+
+// optionalCapabilitiesMethods may receive no capabilities, or capabilities without any access mode
+var optionalCapabilitiesMethods = []string{
+	"/csi.v1.Controller/GetCapacity",
+}
+
+// snapshotMethods receive the parameters of snapshot classes rather than storage classes
+var snapshotMethods = []string{
+	"/csi.v1.Controller/CreateSnapshot",
+	"/csi.v1.GroupController/CreateVolumeGroupSnapshot",
+}
+
+// Controller is the implementation of csi.ControllerServer and csi.GroupControllerServer
 type Controller struct {
 	*common.Driver
 
-	dothillClient *dothill.Client
+	clients        *clientPool
+	pools          *poolPlacer
+	volumeLocks    *keyedLocks
+	initiatorLocks *keyedLocks
+	chapRecords    *chapRecordCache
+
+	kubeClient                  kubernetes.Interface
+	recorder                    record.EventRecorder
+	clusterID                   string
+	fencing                     bool
+	fencingReleasesReservations bool
+	fsFreeze                    *fsFreezeClient
 }
 
 // DriverCtx contains data common to most calls
@@ -90,17 +157,24 @@ type DriverCtx struct {
 
 // New is a convenience fn for creating a controller driver
 func New() *Controller {
-	dothillClient := dothill.NewClient()
+	collector := dothill.NewClient().Collector
 	controller := &Controller{
-		Driver:        common.NewDriver(dothillClient.Collector),
-		dothillClient: dothillClient,
+		Driver:         common.NewDriver(collector),
+		clients:        newClientPool(collector),
+		pools:          newPoolPlacer(),
+		volumeLocks:    newKeyedLocks(),
+		initiatorLocks: newKeyedLocks(),
+		chapRecords:    newChapRecordCache(),
 	}
 
 	controller.InitServer(
 		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-			if mutex, exists := csiMutexes[info.FullMethod]; exists {
-				mutex.Lock()
-				defer mutex.Unlock()
+			if getLockKey, exists := volumeLockedMethods[info.FullMethod]; exists {
+				volumeID := getLockKey(req)
+				if !controller.volumeLocks.TryLock(volumeID) {
+					return nil, status.Errorf(codes.Aborted, "an operation is already in progress on volume %s, try again later", volumeID)
+				}
+				defer controller.volumeLocks.Unlock(volumeID)
 			}
 			return handler(ctx, req)
 		},
@@ -112,18 +186,25 @@ func New() *Controller {
 			if reqWithSecrets, ok := req.(common.WithSecrets); ok {
 				driverContext.Credentials = reqWithSecrets.GetSecrets()
 			}
-			if reqWithParameters, ok := req.(common.WithParameters); ok {
+			selfValidated := containsString(selfValidatedMethods, info.FullMethod)
+			// snapshot class parameters are checked by the snapshot calls, storage class checks do not apply to them
+			if reqWithParameters, ok := req.(common.WithParameters); ok && !selfValidated && !containsString(snapshotMethods, info.FullMethod) {
 				driverContext.Parameters = reqWithParameters.GetParameters()
 			}
-			if reqWithVolumeCaps, ok := req.(common.WithVolumeCaps); ok {
-				driverContext.VolumeCaps = reqWithVolumeCaps.GetVolumeCapabilities()
+			if reqWithVolumeCaps, ok := req.(common.WithVolumeCaps); ok && !selfValidated && !containsString(optionalCapabilitiesMethods, info.FullMethod) {
+				volumeCaps := reqWithVolumeCaps.GetVolumeCapabilities()
+				driverContext.VolumeCaps = &volumeCaps
+			} else if reqWithVolumeCap, ok := req.(common.WithVolumeCap); ok && reqWithVolumeCap.GetVolumeCapability() != nil {
+				driverContext.VolumeCaps = &[]*csi.VolumeCapability{reqWithVolumeCap.GetVolumeCapability()}
 			}
 
-			err := controller.beginRoutine(&driverContext, info.FullMethod)
-			defer controller.endRoutine()
+			client, err := controller.beginRoutine(&driverContext, info.FullMethod)
 			if err != nil {
 				return nil, err
 			}
+			if client != nil {
+				ctx = context.WithValue(ctx, clientContextKey{}, client)
+			}
 
 			return handler(ctx, req)
 		},
@@ -131,6 +212,7 @@ func New() *Controller {
 
 	csi.RegisterIdentityServer(controller.Server, controller)
 	csi.RegisterControllerServer(controller.Server, controller)
+	csi.RegisterGroupControllerServer(controller.Server, controller)
 
 	return controller
 }
@@ -145,6 +227,11 @@ func (controller *Controller) ControllerGetCapabilities(ctx context.Context, req
 		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
 	}
 
 	for _, cap := range cl {
@@ -171,31 +258,26 @@ func (controller *Controller) ValidateVolumeCapabilities(ctx context.Context, re
 	if len(req.GetVolumeCapabilities()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "cannot validate volume without capabilities")
 	}
-	_, _, err := controller.dothillClient.ShowVolumes(volumeID)
-	if err != nil {
-		return nil, status.Error(codes.NotFound, "cannot validate volume not found")
+	if _, err := getVolume(getClient(ctx), volumeID); err != nil {
+		return nil, err
+	}
+
+	if message := getUnsupportedVolumeMessage(req.GetVolumeCapabilities(), req.GetParameters()); message != "" {
+		klog.Infof("volume %s does not support the requested capabilities: %s", volumeID, message)
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: message}, nil
 	}
 
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-			VolumeCapabilities: volumeCapabilities,
+			VolumeCapabilities: req.GetVolumeCapabilities(),
 		},
 	}, nil
 }
 
-// ListVolumes returns a list of all requested volumes
-func (controller *Controller) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "ListVolumes is unimplemented and should not be called")
-}
-
-// GetCapacity returns the capacity of the storage pool
-func (controller *Controller) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "GetCapacity is unimplemented and should not be called")
-}
-
-// ControllerGetVolume fetch current information about a volume
-func (controller *Controller) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "ControllerGetVolume is unimplemented and should not be called")
+// ControllerModifyVolume modifies the parameters of a volume
+// Will not be called as the plugin does not have the MODIFY_VOLUME capability
+func (controller *Controller) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "ControllerModifyVolume is unimplemented and should not be called")
 }
 
 // Probe returns the health and readiness of the plugin
@@ -203,9 +285,9 @@ func (controller *Controller) Probe(ctx context.Context, req *csi.ProbeRequest)
 	return &csi.ProbeResponse{}, nil
 }
 
-func (controller *Controller) beginRoutine(ctx *DriverCtx, methodName string) error {
+func (controller *Controller) beginRoutine(ctx *DriverCtx, methodName string) (*arrayClient, error) {
 	if err := runPreflightChecks(ctx.Parameters, ctx.VolumeCaps); err != nil {
-		return err
+		return nil, err
 	}
 
 	needsAuthentication := true
@@ -217,46 +299,14 @@ func (controller *Controller) beginRoutine(ctx *DriverCtx, methodName string) er
 	}
 
 	if !needsAuthentication {
-		return nil
+		return nil, nil
 	}
 
 	if ctx.Credentials == nil {
-		return errors.New("missing API credentials")
+		return nil, errors.New("missing API credentials")
 	}
 
-	return controller.configureClient(ctx.Credentials)
-}
-
-func (controller *Controller) endRoutine() {
-	controller.dothillClient.HTTPClient.CloseIdleConnections()
-}
-
-func (controller *Controller) configureClient(credentials map[string]string) error {
-	username := string(credentials[common.UsernameSecretKey])
-	password := string(credentials[common.PasswordSecretKey])
-	apiAddr := string(credentials[common.APIAddressConfigKey])
-
-	if len(apiAddr) == 0 || len(username) == 0 || len(password) == 0 {
-		return status.Error(codes.InvalidArgument, "at least one field is missing in credentials secret")
-	}
-
-	klog.Infof("using dothill API at address %s", apiAddr)
-	if controller.dothillClient.Addr == apiAddr && controller.dothillClient.Username == username {
-		klog.Info("dothill client is already configured for this API, skipping login")
-		return nil
-	}
-
-	controller.dothillClient.Username = username
-	controller.dothillClient.Password = password
-	controller.dothillClient.Addr = apiAddr
-	klog.Infof("login into %q as user %q", controller.dothillClient.Addr, controller.dothillClient.Username)
-	err := controller.dothillClient.Login()
-	if err != nil {
-		return status.Error(codes.Unauthenticated, err.Error())
-	}
-
-	klog.Info("login was successful")
-	return nil
+	return controller.clients.Get(ctx.Credentials)
 }
 
 func runPreflightChecks(parameters map[string]string, capabilities *[]*csi.VolumeCapability) error {
@@ -276,26 +326,79 @@ func runPreflightChecks(parameters map[string]string, capabilities *[]*csi.Volum
 	if err := checkIfKeyExistsInConfig(common.FsTypeConfigKey); err != nil {
 		return err
 	}
-	if err := checkIfKeyExistsInConfig(common.PoolConfigKey); err != nil {
-		return err
+	if parameters != nil && len(getPoolNames(parameters)) == 0 {
+		return status.Errorf(codes.InvalidArgument, "'%s' or '%s' is missing from configuration", common.PoolConfigKey, common.PoolsConfigKey)
 	}
-	if err := checkIfKeyExistsInConfig(common.TargetIQNConfigKey); err != nil {
-		return err
+	if placement := parameters[common.PoolPlacementConfigKey]; placement != "" && !containsString(poolPlacements, placement) {
+		return status.Errorf(codes.InvalidArgument, "'%s' must be one of %s", common.PoolPlacementConfigKey, strings.Join(poolPlacements, ", "))
 	}
-	if err := checkIfKeyExistsInConfig(common.PortalsConfigKey); err != nil {
+
+	if err := checkVolumeAttributes(parameters); err != nil {
 		return err
 	}
+	if reservation, ok := parameters[common.ReservationConfigKey]; ok && reservation != "true" && reservation != "false" {
+		return status.Errorf(codes.InvalidArgument, "'%s' must be either true or false", common.ReservationConfigKey)
+	}
+
+	if prefix := parameters[common.VolumePrefixConfigKey]; prefix != "" {
+		if len(prefix) > common.VolumePrefixMaxLength || unsafeCharacters.MatchString(prefix) {
+			return status.Errorf(codes.InvalidArgument, "'%s' must be made of at most %d letters, digits, dots, dashes or underscores", common.VolumePrefixConfigKey, common.VolumePrefixMaxLength)
+		}
+	}
 
 	if capabilities != nil {
 		if len(*capabilities) == 0 {
 			return status.Error(codes.InvalidArgument, "missing volume capabilities")
 		}
 		for _, capability := range *capabilities {
-			if capability.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
-				return status.Error(codes.FailedPrecondition, "dothill storage only supports ReadWriteOnce access mode")
+			if err := checkVolumeCapability(capability); err != nil {
+				return err
 			}
 		}
 	}
 
 	return nil
 }
+
+func checkVolumeCapability(capability *csi.VolumeCapability) error {
+	if capability.GetMount() == nil && capability.GetBlock() == nil {
+		return status.Error(codes.InvalidArgument, "dothill storage only supports mount and block access types")
+	}
+	if !isVolumeCapabilitySupported(capability) {
+		return status.Errorf(codes.FailedPrecondition, "dothill storage does not support %s access mode", capability.GetAccessMode().GetMode())
+	}
+	return nil
+}
+
+// getUnsupportedVolumeMessage explains why the capabilities or parameters cannot be confirmed, or is empty if they can
+func getUnsupportedVolumeMessage(capabilities []*csi.VolumeCapability, parameters map[string]string) string {
+	for _, capability := range capabilities {
+		if err := checkVolumeCapability(capability); err != nil {
+			return status.Convert(err).Message()
+		}
+	}
+	if len(parameters) > 0 {
+		if err := runPreflightChecks(parameters, nil); err != nil {
+			return status.Convert(err).Message()
+		}
+	}
+	return ""
+}
+
+// getProperty returns the value of the given property, or an empty string if it is missing
+func getProperty(object *dothill.Object, name string) string {
+	if property, ok := object.PropertiesMap[name]; ok {
+		return property.Data
+	}
+	return ""
+}
+
+func isVolumeCapabilitySupported(capability *csi.VolumeCapability) bool {
+	for _, supported := range volumeCapabilities {
+		sameAccessType := (capability.GetBlock() != nil) == (supported.GetBlock() != nil)
+		if sameAccessType && capability.GetAccessMode().GetMode() == supported.GetAccessMode().GetMode() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_getUnsupportedVolumeMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	capability := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+	parameters := map[string]string{common.FsTypeConfigKey: "ext4", common.PoolConfigKey: "A"}
+
+	assert.Empty(getUnsupportedVolumeMessage([]*csi.VolumeCapability{capability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}, parameters))
+	assert.Empty(getUnsupportedVolumeMessage([]*csi.VolumeCapability{capability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}, nil))
+	assert.Contains(getUnsupportedVolumeMessage([]*csi.VolumeCapability{capability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}, parameters), "MULTI_NODE_MULTI_WRITER")
+	assert.Contains(getUnsupportedVolumeMessage([]*csi.VolumeCapability{{AccessMode: &csi.VolumeCapability_AccessMode{}}}, parameters), "access types")
+	assert.Contains(getUnsupportedVolumeMessage([]*csi.VolumeCapability{capability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}, map[string]string{common.PoolConfigKey: "A"}), common.FsTypeConfigKey)
+}
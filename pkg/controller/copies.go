@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"strings"
+
+	"github.com/enix/dothill-api-go/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// checkVolumeCopied returns a retryable error while the array is still copying data to the given volume, as
+// the volume must not be used until the copy completes
+func checkVolumeCopied(client *arrayClient, volumeID string) error {
+	response, _, err := client.FormattedRequest("/show/volume-copies")
+	if err != nil {
+		return err
+	}
+
+	if progress, copying := getVolumeCopyProgress(response, volumeID); copying {
+		klog.Infof("volume %s is still being copied (%s)", volumeID, progress)
+		return status.Errorf(codes.Aborted, "volume %s is still being copied (%s), try again later", volumeID, progress)
+	}
+
+	return nil
+}
+
+// getVolumeCopyProgress returns the progress of the copy to the given volume, if any copy to it is in progress
+func getVolumeCopyProgress(response *dothill.Response, volumeID string) (string, bool) {
+	for index := range response.Objects {
+		object := &response.Objects[index]
+		if getProperty(object, "destination-volume") == volumeID {
+			return getProperty(object, "progress"), true
+		}
+	}
+	return "", false
+}
+
+// isSnapshotReady reports whether the array considers the snapshot complete. Firmwares which do not report the
+// status of snapshots create them synchronously.
+func isSnapshotReady(object *dothill.Object) bool {
+	snapshotStatus := getProperty(object, "status")
+	return snapshotStatus == "" || strings.EqualFold(snapshotStatus, "Available")
+}
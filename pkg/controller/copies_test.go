@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/enix/dothill-api-go/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_getVolumeCopyProgress(t *testing.T) {
+	assert := assert.New(t)
+
+	response := &dothill.Response{Objects: []dothill.Object{
+		newTestObject("copy-volumes", map[string]string{"source-volume": "pvc-a", "destination-volume": "pvc-b", "progress": "42%"}),
+		newTestObject("status", map[string]string{"response-type": "Success"}),
+	}}
+
+	progress, copying := getVolumeCopyProgress(response, "pvc-b")
+	assert.True(copying)
+	assert.Equal("42%", progress)
+
+	_, copying = getVolumeCopyProgress(response, "pvc-a")
+	assert.False(copying)
+}
+
+func Test_isSnapshotReady(t *testing.T) {
+	assert := assert.New(t)
+
+	available := newTestObject("snapshots", map[string]string{"status": "Available"})
+	assert.True(isSnapshotReady(&available))
+	unknown := newTestObject("snapshots", map[string]string{})
+	assert.True(isSnapshotReady(&unknown))
+	creating := newTestObject("snapshots", map[string]string{"status": "Unavailable"})
+	assert.False(isSnapshotReady(&creating))
+}
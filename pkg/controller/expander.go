@@ -23,8 +23,6 @@ package controller
 
 import (
 	"context"
-	"fmt"
-	"strconv"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -46,25 +44,7 @@ func (controller *Controller) ControllerExpandVolume(ctx context.Context, req *c
 	}
 	klog.V(2).Infof("requested size: %d bytes", newSize)
 
-	response, _, err := controller.dothillClient.ShowVolumes(volumeID)
-	var expansionSize int64
-	if err != nil {
-		return nil, err
-	} else if volume, ok := response.ObjectsMap["volume"]; !ok {
-		return nil, fmt.Errorf("volume %q not found", volumeID)
-	} else if sizeNumeric, ok := volume.PropertiesMap["size-numeric"]; !ok {
-		return nil, fmt.Errorf("could not get current volume size, thus volume expansion is not possible")
-	} else if currentBlocks, err := strconv.ParseInt(sizeNumeric.Data, 10, 32); err != nil {
-		return nil, fmt.Errorf("could not parse volume size: %v", err)
-	} else {
-		currentSize := currentBlocks * 512
-		klog.V(2).Infof("current size: %d bytes", currentSize)
-		expansionSize = newSize - currentSize
-		klog.V(2).Infof("expanding volume by %d bytes", expansionSize)
-	}
-
-	expansionSizeStr := getSizeStr(expansionSize)
-	if _, _, err := controller.dothillClient.ExpandVolume(volumeID, expansionSizeStr); err != nil {
+	if err := expandVolume(getClient(ctx), volumeID, newSize); err != nil {
 		return nil, err
 	}
 
@@ -75,3 +55,23 @@ func (controller *Controller) ControllerExpandVolume(ctx context.Context, req *c
 		NodeExpansionRequired: true,
 	}, nil
 }
+
+// expandVolume grows the volume to the given size, doing nothing if it is already large enough
+func expandVolume(client *arrayClient, volumeID string, newSize int64) error {
+	volume, err := getVolume(client, volumeID)
+	if err != nil {
+		return err
+	}
+
+	currentSize := getVolumeSize(volume)
+	klog.V(2).Infof("current size: %d bytes", currentSize)
+	if currentSize >= newSize {
+		klog.Infof("volume %q is already %d bytes large", volumeID, currentSize)
+		return nil
+	}
+
+	expansionSize := newSize - currentSize
+	klog.V(2).Infof("expanding volume by %d bytes", expansionSize)
+	_, _, err = client.ExpandVolume(volumeID, getSizeStr(expansionSize))
+	return err
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"context"
+
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// outOfServiceTaintKey is the taint set on nodes which are known to be shut down
+const outOfServiceTaintKey = "node.kubernetes.io/out-of-service"
+
+// EnableFencing lets the controller unmap volumes from the nodes which are confirmed gone when they are published
+// to another node, optionally releasing the SCSI reservations they hold. It requires a Kubernetes client.
+func (controller *Controller) EnableFencing(releaseReservations bool) {
+	controller.fencing = true
+	controller.fencingReleasesReservations = releaseReservations
+}
+
+// fenceInitiators unmaps the volume from the given initiators, provided that the nodes they belong to are all
+// confirmed gone, that is either deleted or tainted as out of service
+func (controller *Controller) fenceInitiators(ctx context.Context, client *arrayClient, volumeID string, initiators []string) error {
+	nodeIDs, err := controller.getNodeIDs(ctx)
+	if err != nil {
+		return err
+	}
+	nodeNames := map[string]string{}
+	for nodeName, nodeID := range nodeIDs {
+		nodeNames[nodeID] = nodeName
+	}
+
+	attachedNodes, err := controller.getVolumeAttachmentNodes(ctx, volumeID)
+	if err != nil {
+		return err
+	}
+
+	for _, initiator := range initiators {
+		gone, err := controller.isInitiatorGone(ctx, initiator, nodeNames, nodeIDs, attachedNodes)
+		if err != nil {
+			return err
+		}
+		if !gone {
+			return status.Errorf(codes.FailedPrecondition, "volume %s is already attached to another node (%s), which is not confirmed gone", volumeID, initiator)
+		}
+	}
+
+	for _, initiator := range initiators {
+		klog.Warningf("fencing initiator %s: unmapping volume %s from it, as its node is gone", initiator, volumeID)
+		_, responseStatus, err := client.UnmapVolume(volumeID, initiator)
+		if err != nil && (responseStatus == nil || responseStatus.ReturnCode != unmapFailedErrorCode) {
+			return err
+		}
+	}
+
+	if controller.fencingReleasesReservations {
+		klog.Warningf("fencing: releasing the SCSI reservations of volume %s", volumeID)
+		if _, _, err := client.FormattedRequest("/release/volume-reservations/%q", volumeID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isInitiatorGone reports whether the node using the initiator is gone. Initiators which are not registered by any
+// node are considered gone if the volume is attached to a gone node, as nodes are unregistered when deleted.
+func (controller *Controller) isInitiatorGone(ctx context.Context, initiator string, nodeNames map[string]string, nodeIDs map[string]string, attachedNodes []string) (bool, error) {
+	if nodeName, ok := nodeNames[initiator]; ok {
+		return controller.isNodeGone(ctx, nodeName)
+	}
+
+	for _, nodeName := range attachedNodes {
+		if _, registered := nodeIDs[nodeName]; registered {
+			continue
+		}
+
+		gone, err := controller.isNodeGone(ctx, nodeName)
+		if err != nil || gone {
+			return gone, err
+		}
+	}
+
+	return false, nil
+}
+
+func (controller *Controller) isNodeGone(ctx context.Context, nodeName string) (bool, error) {
+	node, err := controller.kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		klog.Infof("node %s has been deleted", nodeName)
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == outOfServiceTaintKey && (taint.Effect == v1.TaintEffectNoExecute || taint.Effect == v1.TaintEffectNoSchedule) {
+			klog.Infof("node %s is out of service", nodeName)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// getVolumeAttachmentNodes returns the names of the nodes the volume is attached to, according to the volume attachments
+func (controller *Controller) getVolumeAttachmentNodes(ctx context.Context, volumeID string) ([]string, error) {
+	persistentVolumes, err := controller.kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	persistentVolumeNames := []string{}
+	for _, persistentVolume := range persistentVolumes.Items {
+		if source := persistentVolume.Spec.CSI; source != nil && source.Driver == common.PluginName && source.VolumeHandle == volumeID {
+			persistentVolumeNames = append(persistentVolumeNames, persistentVolume.Name)
+		}
+	}
+
+	volumeAttachments, err := controller.kubeClient.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	nodeNames := []string{}
+	for _, volumeAttachment := range volumeAttachments.Items {
+		name := volumeAttachment.Spec.Source.PersistentVolumeName
+		if volumeAttachment.Spec.Attacher == common.PluginName && name != nil && containsString(persistentVolumeNames, *name) {
+			nodeNames = append(nodeNames, volumeAttachment.Spec.NodeName)
+		}
+	}
+
+	return nodeNames, nil
+}
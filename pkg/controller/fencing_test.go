@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_isInitiatorGone(t *testing.T) {
+	assert := assert.New(t)
+
+	controller := &Controller{kubeClient: fake.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "alive"}},
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "restarting"}},
+		&v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "shutdown"},
+			Spec:       v1.NodeSpec{Taints: []v1.Taint{{Key: outOfServiceTaintKey, Effect: v1.TaintEffectNoExecute}}},
+		},
+	)}
+	nodeIDs := map[string]string{"alive": "iqn.alive", "shutdown": "iqn.shutdown"}
+	nodeNames := map[string]string{"iqn.alive": "alive", "iqn.shutdown": "shutdown"}
+
+	tests := []struct {
+		name          string
+		initiator     string
+		attachedNodes []string
+		gone          bool
+	}{
+		{name: "alive node", initiator: "iqn.alive", attachedNodes: []string{"alive"}},
+		{name: "out of service node", initiator: "iqn.shutdown", attachedNodes: []string{"shutdown"}, gone: true},
+		{name: "deleted node", initiator: "iqn.deleted", attachedNodes: []string{"alive", "deleted"}, gone: true},
+		{name: "unregistered alive node", initiator: "iqn.restarting", attachedNodes: []string{"alive", "restarting"}},
+		{name: "unknown initiator", initiator: "iqn.unknown", attachedNodes: []string{"alive"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gone, err := controller.isInitiatorGone(context.Background(), test.initiator, nodeNames, nodeIDs, test.attachedNodes)
+			assert.Nil(err)
+			assert.Equal(test.gone, gone)
+		})
+	}
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// fsFreezeClient calls the filesystem freeze endpoint served by the nodes
+type fsFreezeClient struct {
+	port      int
+	token     string
+	transport *http.Transport
+}
+
+// EnableFsFreeze lets snapshot classes request the filesystems of the volumes to be frozen while they are snapshotted,
+// using the endpoint served over TLS by the nodes on the given port, whose certificate is issued by one of the given
+// authorities. It requires a Kubernetes client.
+func (controller *Controller) EnableFsFreeze(port int, token string, authorities *x509.CertPool) {
+	controller.fsFreeze = newFsFreezeClient(port, token, &tls.Config{
+		RootCAs:    authorities,
+		ServerName: common.FsFreezeServerName,
+		MinVersion: tls.VersionTLS12,
+	})
+}
+
+func newFsFreezeClient(port int, token string, tlsConfig *tls.Config) *fsFreezeClient {
+	return &fsFreezeClient{port: port, token: token, transport: &http.Transport{TLSClientConfig: tlsConfig}}
+}
+
+// getFsFreezeTimeout returns how long the filesystem may stay frozen when the snapshot class requests it, zero otherwise
+func getFsFreezeTimeout(parameters map[string]string) (time.Duration, error) {
+	switch parameters[common.FsFreezeConfigKey] {
+	case "", "false":
+		return 0, nil
+	case "true":
+	default:
+		return 0, status.Errorf(codes.InvalidArgument, "'%s' must be either true or false", common.FsFreezeConfigKey)
+	}
+
+	value, ok := parameters[common.FsFreezeTimeoutConfigKey]
+	if !ok {
+		return common.DefaultFsFreezeTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 || timeout > common.MaxFsFreezeTimeout {
+		return 0, status.Errorf(codes.InvalidArgument, "'%s' must be a duration up to %s", common.FsFreezeTimeoutConfigKey, common.MaxFsFreezeTimeout)
+	}
+	return timeout, nil
+}
+
+// withFrozenVolume freezes the filesystem of the volume on the nodes it is mapped to while running the given function.
+// It returns DeadlineExceeded if a node thawed the filesystem on its own before the function completed.
+func (controller *Controller) withFrozenVolume(ctx context.Context, client *arrayClient, volumeID string, timeout time.Duration, run func() error) error {
+	if controller.fsFreeze == nil {
+		return status.Error(codes.FailedPrecondition, "filesystem freeze is not enabled on the controller")
+	}
+
+	addresses, err := controller.getVolumeNodeAddresses(ctx, client, volumeID)
+	if err != nil {
+		return err
+	}
+
+	frozen := []string{}
+	defer func() {
+		for _, address := range frozen {
+			controller.fsFreeze.thaw(address, volumeID, timeout)
+		}
+	}()
+	for _, address := range addresses {
+		isFrozen, err := controller.fsFreeze.freeze(address, volumeID, timeout)
+		if err != nil {
+			return status.Errorf(codes.Unavailable, "could not freeze volume %s on node %s: %v", volumeID, address, err)
+		}
+		if isFrozen {
+			frozen = append(frozen, address)
+		}
+	}
+
+	if err = run(); err != nil {
+		return err
+	}
+
+	for len(frozen) > 0 {
+		address := frozen[0]
+		frozen = frozen[1:]
+		if stillFrozen, err := controller.fsFreeze.thaw(address, volumeID, timeout); err != nil {
+			klog.Warningf("could not thaw volume %s on node %s, relying on the node timeout: %v", volumeID, address, err)
+		} else if !stillFrozen {
+			return status.Errorf(codes.DeadlineExceeded, "volume %s was thawed by node %s before the end of the %s timeout", volumeID, address, timeout)
+		}
+	}
+
+	return nil
+}
+
+// getVolumeNodeAddresses returns the addresses of the nodes the volume is mapped to
+func (controller *Controller) getVolumeNodeAddresses(ctx context.Context, client *arrayClient, volumeID string) ([]string, error) {
+	initiators, _, err := getVolumeMapsHostNames(client, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	if len(initiators) == 0 {
+		return nil, nil
+	}
+
+	nodeIDs, err := controller.getNodeIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nodeNames := map[string]string{}
+	for nodeName, nodeID := range nodeIDs {
+		nodeNames[nodeID] = nodeName
+	}
+
+	addresses := []string{}
+	for _, initiator := range initiators {
+		nodeName, ok := nodeNames[initiator]
+		if !ok {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is mapped to initiator %s which is not registered by any node", volumeID, initiator)
+		}
+
+		node, err := controller.kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		address := getNodeAddress(node)
+		if address == "" {
+			return nil, status.Errorf(codes.FailedPrecondition, "node %s has no address", nodeName)
+		}
+		addresses = append(addresses, address)
+	}
+
+	return addresses, nil
+}
+
+// getNodeAddress returns the internal address of the node, or its first address if it has none
+func getNodeAddress(node *v1.Node) string {
+	for _, address := range node.Status.Addresses {
+		if address.Type == v1.NodeInternalIP {
+			return address.Address
+		}
+	}
+	if len(node.Status.Addresses) > 0 {
+		return node.Status.Addresses[0].Address
+	}
+	return ""
+}
+
+// freeze freezes the filesystem of the volume on the node, returning false if it has no filesystem to freeze
+func (freezeClient *fsFreezeClient) freeze(address string, volumeID string, timeout time.Duration) (bool, error) {
+	code, err := freezeClient.request(address, common.FsFreezePath, volumeID, timeout)
+	if err != nil {
+		return false, err
+	}
+	return code == http.StatusOK, nil
+}
+
+// thaw thaws the filesystem of the volume on the node, returning false if the node had already thawed it
+func (freezeClient *fsFreezeClient) thaw(address string, volumeID string, timeout time.Duration) (bool, error) {
+	code, err := freezeClient.request(address, common.FsThawPath, volumeID, timeout)
+	if code == http.StatusConflict {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (freezeClient *fsFreezeClient) request(address string, path string, volumeID string, timeout time.Duration) (int, error) {
+	query := url.Values{"volume": {volumeID}, "timeout": {timeout.String()}}
+	endpoint := fmt.Sprintf("https://%s%s?%s", net.JoinHostPort(address, strconv.Itoa(freezeClient.port)), path, query.Encode())
+
+	request, err := http.NewRequest(http.MethodPost, endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Authorization", "Bearer "+freezeClient.token)
+
+	httpClient := &http.Client{Timeout: timeout, Transport: freezeClient.transport}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(response.Body)
+		return response.StatusCode, fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return response.StatusCode, nil
+}
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+)
+
+func Test_getFsFreezeTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	timeout, err := getFsFreezeTimeout(map[string]string{})
+	assert.Nil(err)
+	assert.Zero(timeout, "filesystems should not be frozen by default")
+
+	timeout, err = getFsFreezeTimeout(map[string]string{common.FsFreezeConfigKey: "true"})
+	assert.Nil(err)
+	assert.Equal(common.DefaultFsFreezeTimeout, timeout)
+
+	timeout, err = getFsFreezeTimeout(map[string]string{common.FsFreezeConfigKey: "true", common.FsFreezeTimeoutConfigKey: "30s"})
+	assert.Nil(err)
+	assert.Equal(30*time.Second, timeout)
+
+	_, err = getFsFreezeTimeout(map[string]string{common.FsFreezeConfigKey: "yes"})
+	assert.Error(err)
+	_, err = getFsFreezeTimeout(map[string]string{common.FsFreezeConfigKey: "true", common.FsFreezeTimeoutConfigKey: "1h"})
+	assert.Error(err, "filesystems should not stay frozen for long")
+}
+
+func Test_getNodeAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	node := &v1.Node{Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+		{Type: v1.NodeHostName, Address: "node-a"},
+		{Type: v1.NodeInternalIP, Address: "10.0.0.1"},
+	}}}
+	assert.Equal("10.0.0.1", getNodeAddress(node))
+	assert.Equal("", getNodeAddress(&v1.Node{}))
+}
+
+func Test_fsFreezeClient(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path + "/" + r.FormValue("volume") {
+		case common.FsFreezePath + "/block":
+			w.WriteHeader(http.StatusNoContent)
+		case common.FsThawPath + "/expired":
+			w.WriteHeader(http.StatusConflict)
+		}
+	}))
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig
+	client := newFsFreezeClient(portNumber, "secret", tlsConfig)
+
+	frozen, err := client.freeze(host, "pvc-a", time.Second)
+	assert.Nil(err)
+	assert.True(frozen)
+	frozen, err = client.freeze(host, "block", time.Second)
+	assert.Nil(err)
+	assert.False(frozen, "raw block volumes have no filesystem to freeze")
+
+	stillFrozen, err := client.thaw(host, "pvc-a", time.Second)
+	assert.Nil(err)
+	assert.True(stillFrozen)
+	stillFrozen, err = client.thaw(host, "expired", time.Second)
+	assert.Nil(err)
+	assert.False(stillFrozen, "volumes thawed by the node timeout should be reported")
+
+	_, err = newFsFreezeClient(portNumber, "invalid", tlsConfig).freeze(host, "pvc-a", time.Second)
+	assert.Error(err)
+	_, err = newFsFreezeClient(portNumber, "secret", &tls.Config{}).freeze(host, "pvc-a", time.Second)
+	assert.Error(err, "certificates issued by unknown authorities should be rejected")
+}
@@ -0,0 +1,315 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// GetPluginCapabilities returns the capabilities of the plugin, adding the group controller service
+// which is only served by the controller
+func (controller *Controller) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	response, err := controller.Driver.GetPluginCapabilities(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Capabilities = append(response.Capabilities, &csi.PluginCapability{
+		Type: &csi.PluginCapability_Service_{
+			Service: &csi.PluginCapability_Service{
+				Type: csi.PluginCapability_Service_GROUP_CONTROLLER_SERVICE,
+			},
+		},
+	})
+	return response, nil
+}
+
+// GroupControllerGetCapabilities returns the capabilities of the group controller service
+func (controller *Controller) GroupControllerGetCapabilities(ctx context.Context, req *csi.GroupControllerGetCapabilitiesRequest) (*csi.GroupControllerGetCapabilitiesResponse, error) {
+	return &csi.GroupControllerGetCapabilitiesResponse{
+		Capabilities: []*csi.GroupControllerServiceCapability{
+			{
+				Type: &csi.GroupControllerServiceCapability_Rpc{
+					Rpc: &csi.GroupControllerServiceCapability_RPC{
+						Type: csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// CreateVolumeGroupSnapshot snapshots the given volumes at the same point in time, using a single array command.
+// The array has no group object, so the snapshots are linked to their group by their metadata.
+func (controller *Controller) CreateVolumeGroupSnapshot(ctx context.Context, req *csi.CreateVolumeGroupSnapshotRequest) (*csi.CreateVolumeGroupSnapshotResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "cannot create group snapshot with empty name")
+	}
+	if len(req.GetSourceVolumeIds()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "cannot create group snapshot without source volume IDs")
+	}
+
+	client := getClient(ctx)
+	groupID := getGroupSnapshotID(req.GetName())
+	sourceVolumeIDs := uniqueStrings(req.GetSourceVolumeIds())
+
+	snapshots, err := listGroupSnapshots(client, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) > 0 {
+		if !sameStrings(getSourceVolumeIDs(snapshots), sourceVolumeIDs) {
+			return nil, status.Errorf(codes.AlreadyExists, "group snapshot %s already exists with different source volumes", groupID)
+		}
+		klog.Infof("group snapshot %s already exists", groupID)
+		return &csi.CreateVolumeGroupSnapshotResponse{GroupSnapshot: newVolumeGroupSnapshot(groupID, snapshots)}, nil
+	}
+
+	names := []string{}
+	for _, volumeID := range sourceVolumeIDs {
+		names = append(names, getGroupMemberSnapshotID(groupID, volumeID))
+	}
+
+	klog.Infof("creating group snapshot %s of volumes %s", groupID, strings.Join(sourceVolumeIDs, ", "))
+	_, respStatus, err := client.FormattedRequest("/create/snapshots/volumes/%q/%q", strings.Join(sourceVolumeIDs, ","), strings.Join(names, ","))
+	if err != nil && (respStatus == nil || respStatus.ReturnCode != snapshotAlreadyExists) {
+		return nil, err
+	}
+
+	// snapshots created by this call are deleted until they are linked to their group, or nothing would ever delete them
+	linked := false
+	if err == nil {
+		defer func() {
+			if linked {
+				return
+			}
+			klog.Infof("deleting snapshots of group snapshot %s which could not be linked to it", groupID)
+			if _, _, err := client.DeleteSnapshot(names...); err != nil {
+				klog.Errorf("could not delete snapshots %s of group snapshot %s: %v", strings.Join(names, ", "), groupID, err)
+			}
+		}()
+	}
+
+	// snapshots may already exist if a previous call was interrupted before storing their metadata
+	response, _, err := client.ShowSnapshots(names...)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := getSnapshotsFromResponse(response, "", "")
+	if err != nil {
+		return nil, err
+	}
+	sources := map[string]string{}
+	for _, entry := range entries {
+		sources[entry.Snapshot.SnapshotId] = entry.Snapshot.SourceVolumeId
+	}
+	for index, name := range names {
+		if sources[name] != sourceVolumeIDs[index] {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists with a different source volume (%s)", name, sources[name])
+		}
+	}
+
+	metadata := objectMetadata{}.SetName(req.GetName()).Set(groupMetadataKey, groupID)
+	for _, name := range names {
+		if err = setVolumeMetadata(client, name, metadata); err != nil {
+			return nil, err
+		}
+	}
+	linked = true
+
+	snapshots, err = listGroupSnapshots(client, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	klog.Infof("created group snapshot %s", groupID)
+	return &csi.CreateVolumeGroupSnapshotResponse{GroupSnapshot: newVolumeGroupSnapshot(groupID, snapshots)}, nil
+}
+
+// DeleteVolumeGroupSnapshot deletes the snapshots of the given group. The function is idempotent.
+func (controller *Controller) DeleteVolumeGroupSnapshot(ctx context.Context, req *csi.DeleteVolumeGroupSnapshotRequest) (*csi.DeleteVolumeGroupSnapshotResponse, error) {
+	groupID := req.GetGroupSnapshotId()
+	if groupID == "" {
+		return nil, status.Error(codes.InvalidArgument, "cannot delete group snapshot with empty ID")
+	}
+
+	client := getClient(ctx)
+	snapshots, err := listGroupSnapshots(client, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		klog.Infof("group snapshot %s does not exist, assuming it has already been deleted", groupID)
+		return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+	}
+
+	// snapshots deleted by a previous call are missing from the group, but the group cannot contain other ones
+	names := getSnapshotIDs(snapshots)
+	for _, name := range names {
+		if len(req.GetSnapshotIds()) > 0 && !containsString(req.GetSnapshotIds(), name) {
+			return nil, status.Errorf(codes.FailedPrecondition, "snapshot %s of group snapshot %s is missing from the request", name, groupID)
+		}
+	}
+
+	klog.Infof("deleting group snapshot %s", groupID)
+	_, respStatus, err := client.DeleteSnapshot(names...)
+	if err != nil && (respStatus == nil || respStatus.ReturnCode != snapshotNotFoundErrorCode) {
+		return nil, err
+	}
+
+	klog.Infof("successfully deleted group snapshot %s", groupID)
+	return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+}
+
+// GetVolumeGroupSnapshot returns the snapshots of the given group
+func (controller *Controller) GetVolumeGroupSnapshot(ctx context.Context, req *csi.GetVolumeGroupSnapshotRequest) (*csi.GetVolumeGroupSnapshotResponse, error) {
+	groupID := req.GetGroupSnapshotId()
+	if groupID == "" {
+		return nil, status.Error(codes.InvalidArgument, "cannot get group snapshot with empty ID")
+	}
+
+	snapshots, err := listGroupSnapshots(getClient(ctx), groupID)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, status.Errorf(codes.NotFound, "group snapshot %s not found", groupID)
+	}
+	if len(req.GetSnapshotIds()) > 0 && !sameStrings(getSnapshotIDs(snapshots), uniqueStrings(req.GetSnapshotIds())) {
+		return nil, status.Errorf(codes.FailedPrecondition, "snapshots of group snapshot %s do not match the request", groupID)
+	}
+
+	return &csi.GetVolumeGroupSnapshotResponse{GroupSnapshot: newVolumeGroupSnapshot(groupID, snapshots)}, nil
+}
+
+// getGroupSnapshotID returns the identifier of the group snapshot with the given name
+func getGroupSnapshotID(name string) string {
+	return getObjectID(name, "", common.DefaultGroupPrefix)
+}
+
+// getGroupMemberSnapshotID returns the name of the array snapshot of the given volume within the group
+func getGroupMemberSnapshotID(groupID string, volumeID string) string {
+	return getSnapshotID(groupID + "-" + volumeID)
+}
+
+// listGroupSnapshots returns the snapshots whose metadata link them to the given group, sorted by ID
+func listGroupSnapshots(client *arrayClient, groupID string) ([]*csi.Snapshot, error) {
+	response, _, err := client.FormattedRequest("/show/volumes")
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for index := range response.Objects {
+		object := &response.Objects[index]
+		if object.Name == "volume" && getProperty(object, "volume-type") == "snapshot" && getVolumeMetadata(object).Matches(groupMetadataKey, groupID) {
+			names = append(names, getProperty(object, "volume-name"))
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	response, _, err = client.ShowSnapshots(names...)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := getSnapshotsFromResponse(response, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []*csi.Snapshot{}
+	for _, entry := range entries {
+		if containsString(names, entry.Snapshot.SnapshotId) {
+			entry.Snapshot.GroupSnapshotId = groupID
+			snapshots = append(snapshots, entry.Snapshot)
+		}
+	}
+	return snapshots, nil
+}
+
+// newVolumeGroupSnapshot returns the group snapshot made of the given snapshots, created when its first snapshot was
+func newVolumeGroupSnapshot(groupID string, snapshots []*csi.Snapshot) *csi.VolumeGroupSnapshot {
+	group := &csi.VolumeGroupSnapshot{
+		GroupSnapshotId: groupID,
+		Snapshots:       snapshots,
+		ReadyToUse:      true,
+	}
+	for _, snapshot := range snapshots {
+		if group.CreationTime == nil || snapshot.CreationTime.AsTime().Before(group.CreationTime.AsTime()) {
+			group.CreationTime = snapshot.CreationTime
+		}
+		group.ReadyToUse = group.ReadyToUse && snapshot.ReadyToUse
+	}
+	return group
+}
+
+func getSnapshotIDs(snapshots []*csi.Snapshot) []string {
+	ids := []string{}
+	for _, snapshot := range snapshots {
+		ids = append(ids, snapshot.SnapshotId)
+	}
+	return ids
+}
+
+func getSourceVolumeIDs(snapshots []*csi.Snapshot) []string {
+	ids := []string{}
+	for _, snapshot := range snapshots {
+		ids = append(ids, snapshot.SourceVolumeId)
+	}
+	return uniqueStrings(ids)
+}
+
+// uniqueStrings returns the sorted values of the slice, without duplicates
+func uniqueStrings(slice []string) []string {
+	values := []string{}
+	for _, value := range slice {
+		if !containsString(values, value) {
+			values = append(values, value)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+// sameStrings reports whether both slices contain the same values, regardless of their order
+func sameStrings(a []string, b []string) bool {
+	a, b = uniqueStrings(a), uniqueStrings(b)
+	if len(a) != len(b) {
+		return false
+	}
+	for index := range a {
+		if a[index] != b[index] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_getGroupMemberSnapshotID(t *testing.T) {
+	assert := assert.New(t)
+
+	groupID := getGroupSnapshotID("groupsnapshot-0a1b2c3d-4e5f-6a7b-8c9d-0e1f2a3b4c5d")
+	assert.True(strings.HasPrefix(groupID, common.DefaultGroupPrefix+"_"))
+
+	snapshotID := getGroupMemberSnapshotID(groupID, "pvc-0a1b2c3d-4e5f-6a7b-8c9d-0e1f2a3b4c5d")
+	assert.LessOrEqual(len(snapshotID), common.VolumeNameMaxLength)
+	assert.NotEqual(snapshotID, getGroupMemberSnapshotID(groupID, "pvc-0a1b2c3d-4e5f-6a7b-8c9d-0e1f2a3b4c5e"))
+}
+
+func Test_newVolumeGroupSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	first, _ := ptypes.TimestampProto(time.Unix(1600000000, 0))
+	second, _ := ptypes.TimestampProto(time.Unix(1600000001, 0))
+	snapshots := []*csi.Snapshot{
+		{SnapshotId: "snap-b", CreationTime: second, ReadyToUse: true},
+		{SnapshotId: "snap-a", CreationTime: first, ReadyToUse: false},
+	}
+
+	group := newVolumeGroupSnapshot("group-a", snapshots)
+	assert.Equal("group-a", group.GroupSnapshotId)
+	assert.Equal(first, group.CreationTime, "groups should be created when their first snapshot was")
+	assert.False(group.ReadyToUse, "groups should only be ready once all their snapshots are")
+
+	snapshots[1].ReadyToUse = true
+	assert.True(newVolumeGroupSnapshot("group-a", snapshots).ReadyToUse)
+}
+
+func Test_sameStrings(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(sameStrings([]string{"pvc-b", "pvc-a"}, []string{"pvc-a", "pvc-b", "pvc-a"}))
+	assert.False(sameStrings([]string{"pvc-a"}, []string{"pvc-a", "pvc-b"}))
+	assert.Equal([]string{"pvc-a", "pvc-b"}, uniqueStrings([]string{"pvc-b", "pvc-a", "pvc-b"}))
+}
+
+func Test_GetPluginCapabilities(t *testing.T) {
+	assert := assert.New(t)
+
+	hasGroupController := func(response *csi.GetPluginCapabilitiesResponse) bool {
+		for _, capability := range response.GetCapabilities() {
+			if capability.GetService().GetType() == csi.PluginCapability_Service_GROUP_CONTROLLER_SERVICE {
+				return true
+			}
+		}
+		return false
+	}
+
+	driver := common.NewDriver()
+	response, err := driver.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+	assert.Nil(err)
+	assert.False(hasGroupController(response), "nodes should not advertise the group controller service")
+
+	controller := &Controller{Driver: driver}
+	response, err = controller.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+	assert.Nil(err)
+	assert.True(hasGroupController(response))
+}
@@ -0,0 +1,293 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+// Storage class parameters referencing the secret used by the external-provisioner
+const (
+	provisionerSecretNameParameter      = "csi.storage.k8s.io/provisioner-secret-name"
+	provisionerSecretNamespaceParameter = "csi.storage.k8s.io/provisioner-secret-namespace"
+)
+
+// storageClassArray is an array used by the storage classes of the driver, along with the pools they use on it
+type storageClassArray struct {
+	client *arrayClient
+	pools  []string
+}
+
+// SetKubernetesClient gives the controller access to the Kubernetes API, which is required to find the arrays of the storage classes
+func (controller *Controller) SetKubernetesClient(kubeClient kubernetes.Interface) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+
+	controller.kubeClient = kubeClient
+	controller.recorder = broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: common.PluginName})
+}
+
+// getStorageClassArrays returns the arrays used by the storage classes of the driver, logging in
+// using the provisioner secrets referenced by the storage classes
+func (controller *Controller) getStorageClassArrays(ctx context.Context) ([]*storageClassArray, error) {
+	if controller.kubeClient == nil {
+		return nil, status.Error(codes.FailedPrecondition, "the controller has no access to the Kubernetes API, cannot find the arrays of the storage classes")
+	}
+
+	storageClasses, err := controller.kubeClient.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not list storage classes: %v", err)
+	}
+
+	arrays := map[*arrayClient]*storageClassArray{}
+	for _, storageClass := range storageClasses.Items {
+		if storageClass.Provisioner != common.PluginName {
+			continue
+		}
+
+		client, err := controller.getProvisionerSecretClient(ctx, storageClass.Parameters)
+		if err != nil {
+			klog.Warningf("could not log in the array of storage class %s: %v", storageClass.Name, err)
+			continue
+		} else if client == nil {
+			klog.V(2).Infof("storage class %s does not reference a static provisioner secret, skipping it", storageClass.Name)
+			continue
+		}
+
+		array, ok := arrays[client]
+		if !ok {
+			array = &storageClassArray{client: client}
+			arrays[client] = array
+		}
+		for _, pool := range getPoolNames(storageClass.Parameters) {
+			if !containsString(array.pools, pool) {
+				array.pools = append(array.pools, pool)
+			}
+		}
+	}
+
+	sortedArrays := []*storageClassArray{}
+	for _, array := range arrays {
+		sortedArrays = append(sortedArrays, array)
+	}
+	sort.Slice(sortedArrays, func(i, j int) bool {
+		return sortedArrays[i].client.Addr < sortedArrays[j].client.Addr
+	})
+
+	return sortedArrays, nil
+}
+
+// getProvisionerSecretClient logs in the array using the provisioner secret referenced by the given storage class
+// parameters. No client is returned if they do not reference a secret, or only a templated one.
+func (controller *Controller) getProvisionerSecretClient(ctx context.Context, parameters map[string]string) (*arrayClient, error) {
+	secretName := parameters[provisionerSecretNameParameter]
+	secretNamespace := parameters[provisionerSecretNamespaceParameter]
+	if secretName == "" || strings.Contains(secretName+secretNamespace, "${") {
+		return nil, nil
+	}
+
+	secret, err := controller.kubeClient.CoreV1().Secrets(secretNamespace).Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get secret %s/%s: %v", secretNamespace, secretName, err)
+	}
+
+	credentials := map[string]string{}
+	for key, value := range secret.Data {
+		credentials[key] = string(value)
+	}
+
+	return controller.clients.Get(credentials)
+}
+
+// getPersistentVolumeHandles returns the reclaim policies of the persistent volumes of the driver, indexed by volume handle
+func (controller *Controller) getPersistentVolumeHandles(ctx context.Context) (map[string]v1.PersistentVolumeReclaimPolicy, error) {
+	persistentVolumes, err := controller.kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	handles := map[string]v1.PersistentVolumeReclaimPolicy{}
+	for _, persistentVolume := range persistentVolumes.Items {
+		if source := persistentVolume.Spec.CSI; source != nil && source.Driver == common.PluginName {
+			handles[source.VolumeHandle] = persistentVolume.Spec.PersistentVolumeReclaimPolicy
+		}
+	}
+
+	return handles, nil
+}
+
+// getClaimReclaimPolicy returns the reclaim policy of the storage class of the claim a volume is provisioned for,
+// or an empty policy when the claim is not known (see --extra-create-metadata)
+func (controller *Controller) getClaimReclaimPolicy(ctx context.Context, parameters map[string]string) (v1.PersistentVolumeReclaimPolicy, error) {
+	namespace, name := parameters[common.PVCNamespaceConfigKey], parameters[common.PVCNameConfigKey]
+	if name == "" {
+		return "", nil
+	}
+
+	claim, err := controller.kubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if claim.Spec.StorageClassName == nil || *claim.Spec.StorageClassName == "" {
+		return "", nil
+	}
+
+	storageClass, err := controller.kubeClient.StorageV1().StorageClasses().Get(ctx, *claim.Spec.StorageClassName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if storageClass.ReclaimPolicy == nil {
+		return v1.PersistentVolumeReclaimDelete, nil
+	}
+
+	return *storageClass.ReclaimPolicy, nil
+}
+
+// getNodePublishSecrets returns the node publish secret of the persistent volume of the given volume,
+// which holds its CHAP secrets, or nil if it has none
+func (controller *Controller) getNodePublishSecrets(ctx context.Context, volumeID string, volumeContext map[string]string) (map[string]string, error) {
+	if controller.kubeClient == nil {
+		return nil, nil
+	}
+
+	var source *v1.CSIPersistentVolumeSource
+	if name := volumeContext[common.PVNameConfigKey]; name != "" {
+		persistentVolume, err := controller.kubeClient.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+		if err == nil && persistentVolume.Spec.CSI != nil && persistentVolume.Spec.CSI.VolumeHandle == volumeID {
+			source = persistentVolume.Spec.CSI
+		}
+	}
+	if source == nil {
+		persistentVolumes, err := controller.kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "could not list persistent volumes: %v", err)
+		}
+		for _, persistentVolume := range persistentVolumes.Items {
+			if csi := persistentVolume.Spec.CSI; csi != nil && csi.Driver == common.PluginName && csi.VolumeHandle == volumeID {
+				source = csi
+				break
+			}
+		}
+	}
+	if source == nil || source.NodePublishSecretRef == nil {
+		return nil, nil
+	}
+
+	reference := source.NodePublishSecretRef
+	secret, err := controller.kubeClient.CoreV1().Secrets(reference.Namespace).Get(ctx, reference.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not get node publish secret %s/%s of volume %s: %v", reference.Namespace, reference.Name, volumeID, err)
+	}
+
+	secrets := map[string]string{}
+	for key, value := range secret.Data {
+		secrets[key] = string(value)
+	}
+	return secrets, nil
+}
+
+// anyNode is used in place of a node ID when the node a volume is attached to cannot be identified
+const anyNode = "*"
+
+// getVolumeAttachments returns the IDs of the nodes each volume of the driver is attached to, according to the
+// volume attachments. Volumes attached to nodes which are not registered anymore are attached to anyNode.
+func (controller *Controller) getVolumeAttachments(ctx context.Context) (map[string][]string, error) {
+	nodeIDs, err := controller.getNodeIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	persistentVolumes, err := controller.kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	handles := map[string]string{}
+	for _, persistentVolume := range persistentVolumes.Items {
+		if source := persistentVolume.Spec.CSI; source != nil && source.Driver == common.PluginName {
+			handles[persistentVolume.Name] = source.VolumeHandle
+		}
+	}
+
+	volumeAttachments, err := controller.kubeClient.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := map[string][]string{}
+	for _, volumeAttachment := range volumeAttachments.Items {
+		if volumeAttachment.Spec.Attacher != common.PluginName {
+			continue
+		}
+
+		var handle string
+		if name := volumeAttachment.Spec.Source.PersistentVolumeName; name != nil {
+			handle = handles[*name]
+		} else if spec := volumeAttachment.Spec.Source.InlineVolumeSpec; spec != nil && spec.CSI != nil {
+			handle = spec.CSI.VolumeHandle
+		}
+		if handle == "" {
+			klog.V(2).Infof("could not find the volume of attachment %s", volumeAttachment.Name)
+			continue
+		}
+
+		nodeID, ok := nodeIDs[volumeAttachment.Spec.NodeName]
+		if !ok {
+			nodeID = anyNode
+		}
+		attachments[handle] = append(attachments[handle], nodeID)
+	}
+
+	return attachments, nil
+}
+
+// getNodeIDs returns the IDs given by the driver to the nodes, indexed by node name
+func (controller *Controller) getNodeIDs(ctx context.Context) (map[string]string, error) {
+	csiNodes, err := controller.kubeClient.StorageV1().CSINodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	nodeIDs := map[string]string{}
+	for _, csiNode := range csiNodes.Items {
+		for _, driver := range csiNode.Spec.Drivers {
+			if driver.Name == common.PluginName {
+				nodeIDs[csiNode.Name] = driver.NodeID
+			}
+		}
+	}
+
+	return nodeIDs, nil
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog"
+)
+
+// leaderElectionLease is the name of the lease electing the controller replica running the reconcilers
+const leaderElectionLease = common.PluginName + "-reconcilers"
+
+// RunWhenLeader calls run once this controller replica holds the reconcilers lease of the given namespace, so that
+// the reconcilers never run on several replicas at once. It exits the process when the lease is lost and never returns.
+func (controller *Controller) RunWhenLeader(namespace string, run func(ctx context.Context)) {
+	identity, err := os.Hostname()
+	if err != nil {
+		klog.Fatalf("could not get the leader election identity: %v", err)
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      leaderElectionLease,
+			Namespace: namespace,
+		},
+		Client:     controller.kubeClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	klog.Infof("waiting for lease %s/%s to run the reconcilers (identity %s)", namespace, leaderElectionLease, identity)
+	leaderelection.RunOrDie(context.Background(), leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				klog.Infof("acquired lease %s/%s", namespace, leaderElectionLease)
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				klog.Fatalf("lost lease %s/%s", namespace, leaderElectionLease)
+			},
+		},
+	})
+}
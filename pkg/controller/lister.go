@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/enix/dothill-api-go/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// ListVolumes returns the volumes in the pools of the storage classes of the driver, including the ones it did not
+// store metadata on, so that volumes provisioned by previous releases are still reported
+func (controller *Controller) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "cannot list volumes with a negative max entries count")
+	}
+
+	arrays, err := controller.getStorageClassArrays(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := []*csi.ListVolumesResponse_Entry{}
+	for _, array := range arrays {
+		clientVolumes, err := listVolumes(array.client, array.pools, controller.clusterID)
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, clientVolumes...)
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].Volume.VolumeId < volumes[j].Volume.VolumeId
+	})
+
+	start, end, nextToken, err := paginate(len(volumes), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	klog.V(2).Infof("listing volumes %d to %d out of %d", start, end, len(volumes))
+
+	return &csi.ListVolumesResponse{
+		Entries:   volumes[start:end],
+		NextToken: nextToken,
+	}, nil
+}
+
+// ControllerGetVolume fetch current information about a volume
+func (controller *Controller) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "cannot get volume with empty ID")
+	}
+
+	arrays, err := controller.getStorageClassArrays(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, array := range arrays {
+		client := array.client
+		object, err := getVolume(client, volumeID)
+		if status.Code(err) == codes.NotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		hostNames, _, err := getVolumeMapsHostNames(client, volumeID)
+		if err != nil {
+			return nil, err
+		}
+
+		return &csi.ControllerGetVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId:      volumeID,
+				CapacityBytes: getVolumeSize(object),
+				VolumeContext: getVolumeMetadata(object).VolumeContext(),
+			},
+			Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+				PublishedNodeIds: hostNames,
+				VolumeCondition:  getVolumeCondition(object),
+			},
+		}, nil
+	}
+
+	return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+}
+
+func listVolumes(client *arrayClient, pools []string, clusterID string) ([]*csi.ListVolumesResponse_Entry, error) {
+	response, _, err := client.FormattedRequest("/show/volumes")
+	if err != nil {
+		return nil, err
+	}
+
+	hostNames, _, err := getAllVolumeMapsHostNames(client)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*csi.ListVolumesResponse_Entry{}
+	for index := range response.Objects {
+		object := &response.Objects[index]
+		if !isBaseVolume(object, pools, clusterID) {
+			continue
+		}
+
+		volumeID := getProperty(object, "volume-name")
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      volumeID,
+				CapacityBytes: getVolumeSize(object),
+				VolumeContext: getVolumeMetadata(object).VolumeContext(),
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: hostNames[volumeID],
+				VolumeCondition:  getVolumeCondition(object),
+			},
+		})
+	}
+
+	return entries, nil
+}
+
+func getVolume(client *arrayClient, volumeID string) (*dothill.Object, error) {
+	response, responseStatus, err := client.ShowVolumes(volumeID)
+	if err != nil {
+		if responseStatus != nil && responseStatus.ReturnCode == volumeShowNotFoundErrorCode {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+		}
+		return nil, err
+	}
+
+	for index := range response.Objects {
+		object := &response.Objects[index]
+		if object.Name == "volume" && getProperty(object, "volume-name") == volumeID {
+			return object, nil
+		}
+	}
+
+	return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+}
+
+// getVolumeCondition reports the volume as abnormal whenever the array does not consider it healthy
+func getVolumeCondition(object *dothill.Object) *csi.VolumeCondition {
+	health := getProperty(object, "health")
+	switch strings.ToLower(health) {
+	case "ok", "":
+		return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+	}
+
+	message := fmt.Sprintf("volume health is %s", health)
+	if reason := getProperty(object, "health-reason"); reason != "" {
+		message = fmt.Sprintf("%s: %s", message, reason)
+	}
+	if recommendation := getProperty(object, "health-recommendation"); recommendation != "" {
+		message = fmt.Sprintf("%s (%s)", message, recommendation)
+	}
+
+	return &csi.VolumeCondition{Abnormal: true, Message: message}
+}
+
+// paginate returns the bounds of the requested page among count entries, and the token of the next page if any
+func paginate(count int, startingToken string, maxEntries int32) (int, int, string, error) {
+	start := 0
+	if startingToken != "" {
+		var err error
+		start, err = strconv.Atoi(startingToken)
+		if err != nil || start < 0 || start > count {
+			return 0, 0, "", status.Errorf(codes.Aborted, "invalid starting token %q", startingToken)
+		}
+	}
+
+	end := count
+	if maxEntries > 0 && start+int(maxEntries) < count {
+		end = start + int(maxEntries)
+	}
+
+	nextToken := ""
+	if end < count {
+		nextToken = strconv.Itoa(end)
+	}
+
+	return start, end, nextToken, nil
+}
+
+func getVolumeSize(object *dothill.Object) int64 {
+	blocks, _ := strconv.ParseInt(getProperty(object, "blocks"), 10, 64)
+	blocksize, _ := strconv.ParseInt(getProperty(object, "blocksize"), 10, 64)
+
+	return blocks * blocksize
+}
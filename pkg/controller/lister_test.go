@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_paginate(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		name          string
+		count         int
+		startingToken string
+		maxEntries    int32
+		start         int
+		end           int
+		nextToken     string
+		fails         bool
+	}{
+		{name: "all entries", count: 5, start: 0, end: 5},
+		{name: "first page", count: 5, maxEntries: 2, start: 0, end: 2, nextToken: "2"},
+		{name: "middle page", count: 5, startingToken: "2", maxEntries: 2, start: 2, end: 4, nextToken: "4"},
+		{name: "last page", count: 5, startingToken: "4", maxEntries: 2, start: 4, end: 5},
+		{name: "empty list", count: 0, start: 0, end: 0},
+		{name: "token out of range", count: 5, startingToken: "6", fails: true},
+		{name: "invalid token", count: 5, startingToken: "abc", fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, end, nextToken, err := paginate(test.count, test.startingToken, test.maxEntries)
+			if test.fails {
+				assert.Error(err)
+				return
+			}
+			assert.Nil(err)
+			assert.Equal(test.start, start)
+			assert.Equal(test.end, end)
+			assert.Equal(test.nextToken, nextToken)
+		})
+	}
+}
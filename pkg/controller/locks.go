@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import "sync"
+
+// keyedLocks hands out one lock per key, so that operations on unrelated keys can run concurrently
+type keyedLocks struct {
+	mutex sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	held  chan struct{}
+	users int
+}
+
+func newKeyedLocks() *keyedLocks {
+	return &keyedLocks{locks: map[string]*keyedLock{}}
+}
+
+// TryLock locks the given key if it is not already locked, and reports whether it did
+func (locks *keyedLocks) TryLock(key string) bool {
+	lock := locks.acquire(key)
+	select {
+	case lock.held <- struct{}{}:
+		return true
+	default:
+		locks.release(key)
+		return false
+	}
+}
+
+// Lock locks the given key, waiting for it to be unlocked if needed
+func (locks *keyedLocks) Lock(key string) {
+	lock := locks.acquire(key)
+	lock.held <- struct{}{}
+}
+
+// Unlock unlocks the given key, which must have been locked before
+func (locks *keyedLocks) Unlock(key string) {
+	locks.mutex.Lock()
+	lock := locks.locks[key]
+	locks.mutex.Unlock()
+
+	<-lock.held
+	locks.release(key)
+}
+
+func (locks *keyedLocks) acquire(key string) *keyedLock {
+	locks.mutex.Lock()
+	defer locks.mutex.Unlock()
+
+	lock, ok := locks.locks[key]
+	if !ok {
+		lock = &keyedLock{held: make(chan struct{}, 1)}
+		locks.locks[key] = lock
+	}
+	lock.users++
+	return lock
+}
+
+func (locks *keyedLocks) release(key string) {
+	locks.mutex.Lock()
+	defer locks.mutex.Unlock()
+
+	lock := locks.locks[key]
+	lock.users--
+	if lock.users == 0 {
+		delete(locks.locks, key)
+	}
+}
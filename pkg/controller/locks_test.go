@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_keyedLocks(t *testing.T) {
+	assert := assert.New(t)
+	locks := newKeyedLocks()
+
+	assert.True(locks.TryLock("volume-1"))
+	assert.False(locks.TryLock("volume-1"), "a locked key should not be locked twice")
+	assert.True(locks.TryLock("volume-2"), "unrelated keys should be locked independently")
+
+	locks.Unlock("volume-1")
+	assert.True(locks.TryLock("volume-1"), "an unlocked key should be lockable again")
+
+	locked := make(chan struct{})
+	go func() {
+		locks.Lock("volume-2")
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("Lock should wait for the key to be unlocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	locks.Unlock("volume-2")
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("Lock should succeed once the key has been unlocked")
+	}
+
+	locks.Unlock("volume-1")
+	locks.Unlock("volume-2")
+	assert.Empty(locks.locks, "unused locks should be released")
+}
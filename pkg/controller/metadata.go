@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/enix/dothill-api-go/v2"
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"k8s.io/klog"
+)
+
+// Metadata keys stored in the description of array objects
+const (
+	hashMetadataKey         = "hash"
+	clusterMetadataKey      = "cluster"
+	retainMetadataKey       = "retain"
+	nameMetadataKey         = "name"
+	pvcNamespaceMetadataKey = "namespace"
+	pvcNameMetadataKey      = "pvc"
+	pvNameMetadataKey       = "pv"
+	groupMetadataKey        = "group"
+)
+
+// descriptionMaxLength is the maximum length of volume descriptions accepted by the array
+const descriptionMaxLength = 127
+
+// nameHashLength is the length of the hash of CSI object names, short enough to always fit in descriptions
+const nameHashLength = 16
+
+// unsafeCharacters matches what cannot be used safely in array object names and descriptions, as they go through the API URL
+var unsafeCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// metadataKeysOrder lists the keys to keep first when the description is too short for all of them
+var metadataKeysOrder = []string{
+	hashMetadataKey,
+	clusterMetadataKey,
+	retainMetadataKey,
+	nameMetadataKey,
+	pvcNamespaceMetadataKey,
+	pvcNameMetadataKey,
+	pvNameMetadataKey,
+}
+
+// workloadMetadataKeys maps the parameters added by the external-provisioner when started
+// with --extra-create-metadata to the metadata keys they are stored under
+var workloadMetadataKeys = map[string]string{
+	common.PVCNamespaceConfigKey: pvcNamespaceMetadataKey,
+	common.PVCNameConfigKey:      pvcNameMetadataKey,
+	common.PVNameConfigKey:       pvNameMetadataKey,
+}
+
+// objectMetadata is stored in the description of array objects as space separated key=value pairs,
+// so that array objects can be linked back to the CSI objects they were created for
+type objectMetadata map[string]string
+
+// sanitizeMetadataValue replaces the characters which cannot be stored in a description
+func sanitizeMetadataValue(value string) string {
+	return unsafeCharacters.ReplaceAllString(value, "_")
+}
+
+// Set stores the value under the given key, sanitizing it first
+func (metadata objectMetadata) Set(key, value string) objectMetadata {
+	metadata[key] = sanitizeMetadataValue(value)
+	return metadata
+}
+
+// Matches reports whether the value stored under the given key is the given value, once sanitized
+func (metadata objectMetadata) Matches(key, value string) bool {
+	return metadata[key] == sanitizeMetadataValue(value)
+}
+
+// getNameHash returns a fixed-length hash of the exact name of a CSI object
+func getNameHash(name string) string {
+	hash := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(hash[:])[:nameHashLength]
+}
+
+// SetName stores the name of the CSI object the array object was created for, along with its hash
+// which identifies the object even when the name is sanitized or does not fit in the description
+func (metadata objectMetadata) SetName(name string) objectMetadata {
+	metadata[hashMetadataKey] = getNameHash(name)
+	return metadata.Set(nameMetadataKey, name)
+}
+
+// ConflictsWith reports whether the array object was created for another CSI object than the one with the given name.
+// Objects created before the hash was stored are compared by name, objects without metadata conflict with none.
+func (metadata objectMetadata) ConflictsWith(name string) bool {
+	if hash, ok := metadata[hashMetadataKey]; ok {
+		return hash != getNameHash(name)
+	}
+	if _, ok := metadata[nameMetadataKey]; ok {
+		return !metadata.Matches(nameMetadataKey, name)
+	}
+	return false
+}
+
+// getVolumeCreationMetadata returns the metadata of a volume created for the given request name and parameters.
+// The PV name is only stored when it differs from the request name, as it usually is the same.
+func getVolumeCreationMetadata(name string, parameters map[string]string) objectMetadata {
+	metadata := objectMetadata{}.SetName(name)
+	for parameter, key := range workloadMetadataKeys {
+		if value := parameters[parameter]; value != "" && (key != pvNameMetadataKey || value != name) {
+			metadata.Set(key, value)
+		}
+	}
+	return metadata
+}
+
+// VolumeContext returns the workload metadata using the keys of the parameters it was read from
+func (metadata objectMetadata) VolumeContext() map[string]string {
+	if _, ok := metadata[pvcNameMetadataKey]; !ok {
+		return nil
+	}
+
+	context := map[string]string{}
+	for parameter, key := range workloadMetadataKeys {
+		if value, ok := metadata[key]; ok {
+			context[parameter] = value
+		}
+	}
+	if _, ok := context[common.PVNameConfigKey]; !ok && metadata[nameMetadataKey] != "" {
+		context[common.PVNameConfigKey] = metadata[nameMetadataKey]
+	}
+
+	return context
+}
+
+func parseObjectMetadata(description string) objectMetadata {
+	metadata := objectMetadata{}
+	for _, field := range strings.Fields(description) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		metadata[parts[0]] = parts[1]
+	}
+
+	return metadata
+}
+
+func getVolumeMetadata(object *dothill.Object) objectMetadata {
+	return parseObjectMetadata(getProperty(object, "volume-description"))
+}
+
+// String encodes the metadata, dropping the fields which do not fit in a description
+func (metadata objectMetadata) String() string {
+	keys := []string{}
+	for _, key := range metadataKeysOrder {
+		if _, ok := metadata[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+
+	otherKeys := []string{}
+	for key := range metadata {
+		if !containsString(metadataKeysOrder, key) {
+			otherKeys = append(otherKeys, key)
+		}
+	}
+	sort.Strings(otherKeys)
+	keys = append(keys, otherKeys...)
+
+	fields := []string{}
+	length := 0
+	for _, key := range keys {
+		field := key + "=" + sanitizeMetadataValue(metadata[key])
+		if length+len(field)+len(fields) > descriptionMaxLength {
+			klog.Warningf("metadata %q does not fit in the description of the array object, skipping it", key)
+			continue
+		}
+		fields = append(fields, field)
+		length += len(field)
+	}
+
+	return strings.Join(fields, " ")
+}
+
+func setVolumeMetadata(client *arrayClient, volumeID string, metadata objectMetadata) error {
+	klog.V(2).Infof("storing metadata of volume %s: %s", volumeID, metadata)
+	_, _, err := client.FormattedRequest("/set/volume/identifying-information/%q/%q", metadata.String(), volumeID)
+	return err
+}
+
+func containsString(slice []string, value string) bool {
+	for _, item := range slice {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_objectMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	metadata := objectMetadata{}.Set(nameMetadataKey, "pvc-0a1b2c3d").Set("other", "a,b <c>")
+	assert.Equal("name=pvc-0a1b2c3d other=a_b__c_", metadata.String(), "forbidden characters should be replaced")
+
+	parsed := parseObjectMetadata(metadata.String())
+	assert.True(parsed.Matches(nameMetadataKey, "pvc-0a1b2c3d"))
+	assert.True(parsed.Matches("other", "a,b <c>"))
+	assert.False(parsed.Matches(nameMetadataKey, "pvc-0a1b2c3e"))
+
+	assert.Empty(parseObjectMetadata("description written by an administrator"))
+
+	long := objectMetadata{}.Set(nameMetadataKey, "pvc").Set("other", strings.Repeat("x", descriptionMaxLength))
+	assert.Equal("name=pvc", long.String(), "fields which do not fit should be dropped")
+}
+
+func Test_objectMetadata_ConflictsWith(t *testing.T) {
+	assert := assert.New(t)
+
+	metadata := parseObjectMetadata(objectMetadata{}.SetName("a/b").String())
+	assert.False(metadata.ConflictsWith("a/b"))
+	assert.True(metadata.ConflictsWith("a_b"), "names sanitized the same way should not be confused")
+
+	longName := strings.Repeat("x", descriptionMaxLength)
+	metadata = parseObjectMetadata(objectMetadata{}.SetName(longName).String())
+	assert.NotContains(metadata, nameMetadataKey, "names too long for the description should be dropped")
+	assert.False(metadata.ConflictsWith(longName))
+	assert.True(metadata.ConflictsWith(longName+"y"), "the hash should be kept when the name does not fit")
+
+	legacy := parseObjectMetadata("name=pvc-a")
+	assert.False(legacy.ConflictsWith("pvc-a"))
+	assert.True(legacy.ConflictsWith("pvc-b"))
+	assert.False(objectMetadata{}.ConflictsWith("pvc-a"))
+}
+
+func Test_getVolumeCreationMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	parameters := map[string]string{
+		"csi.storage.k8s.io/pvc/name":      "data",
+		"csi.storage.k8s.io/pvc/namespace": "default",
+		"csi.storage.k8s.io/pv/name":       "pvc-0a1b2c3d",
+		"fsType":                           "ext4",
+	}
+
+	metadata := getVolumeCreationMetadata("pvc-0a1b2c3d", parameters)
+	assert.Equal("hash="+getNameHash("pvc-0a1b2c3d")+" name=pvc-0a1b2c3d namespace=default pvc=data", metadata.String())
+
+	delete(parameters, "fsType")
+	assert.Equal(parameters, parseObjectMetadata(metadata.String()).VolumeContext())
+	assert.Nil(getVolumeCreationMetadata("pvc-0a1b2c3d", nil).VolumeContext())
+}
@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/enix/dothill-api-go/v2"
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// orphanedVolume is an array volume created by the driver which is not referenced by any persistent volume
+type orphanedVolume struct {
+	id        string
+	metadata  objectMetadata
+	firstSeen time.Time
+	reported  bool
+}
+
+// orphanReconciler looks for orphaned volumes, and deletes them after a grace period if enabled
+type orphanReconciler struct {
+	controller  *Controller
+	clusterID   string
+	gracePeriod time.Duration
+	orphans     map[string]map[string]*orphanedVolume
+}
+
+// clusterIDPattern matches the cluster IDs which can be stored in the description of array volumes
+var clusterIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,63}$`)
+
+// SetClusterID sets the ID stored in the metadata of the volumes created by the controller, which identifies the
+// volumes of this cluster among the ones created by the driver from other clusters sharing the same pools
+func (controller *Controller) SetClusterID(clusterID string) error {
+	if !clusterIDPattern.MatchString(clusterID) {
+		return fmt.Errorf("invalid cluster ID %q, it must be made of at most 63 letters, digits, dots, dashes and underscores", clusterID)
+	}
+	controller.clusterID = clusterID
+	return nil
+}
+
+// setOwnershipMetadata stores the cluster ID in the metadata of a volume being created, and marks it as retained
+// when the storage class of its claim retains persistent volumes, so that it is never deleted as an orphan
+func (controller *Controller) setOwnershipMetadata(ctx context.Context, metadata objectMetadata, parameters map[string]string) {
+	if controller.clusterID != "" {
+		metadata[clusterMetadataKey] = controller.clusterID
+	}
+	if controller.kubeClient == nil {
+		return
+	}
+
+	policy, err := controller.getClaimReclaimPolicy(ctx, parameters)
+	if err != nil {
+		klog.Warningf("could not get the reclaim policy of the volume claim, it will be found by the orphaned volumes reconciler: %v", err)
+		return
+	}
+	if policy == v1.PersistentVolumeReclaimRetain {
+		metadata[retainMetadataKey] = "true"
+	}
+}
+
+// RunOrphanReconciler periodically reports the orphaned volumes of the arrays used by the storage classes of the
+// driver, and deletes them once they have been orphaned for the grace period, unless it is zero. Only the volumes
+// created with the cluster ID of the controller are considered. It returns once the context is done.
+func (controller *Controller) RunOrphanReconciler(ctx context.Context, interval time.Duration, gracePeriod time.Duration) {
+	reconciler := &orphanReconciler{
+		controller:  controller,
+		clusterID:   controller.clusterID,
+		gracePeriod: gracePeriod,
+		orphans:     map[string]map[string]*orphanedVolume{},
+	}
+
+	klog.Infof("starting orphaned volumes reconciler (cluster %s, interval %s, deletion grace period %s)", reconciler.clusterID, interval, gracePeriod)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := reconciler.reconcile(ctx); err != nil {
+			klog.Errorf("could not reconcile orphaned volumes: %v", err)
+		}
+	}, interval)
+}
+
+func (reconciler *orphanReconciler) reconcile(ctx context.Context) error {
+	arrays, err := reconciler.controller.getStorageClassArrays(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, array := range arrays {
+		volumes, err := listDriverVolumes(array.client, array.pools, "")
+		if err != nil {
+			klog.Errorf("could not list volumes of array %s: %v", array.client.Addr, err)
+			continue
+		}
+
+		// persistent volumes are listed after array volumes, so that volumes being provisioned are found
+		handles, err := reconciler.controller.getPersistentVolumeHandles(ctx)
+		if err != nil {
+			return err
+		}
+
+		reconciler.updateOwnership(array.client, volumes, handles)
+		orphans := reconciler.track(array.client.Addr, volumes, handles, time.Now())
+		reconciler.controller.Collector().SetOrphanedVolumes(array.client.Addr, len(orphans))
+
+		for _, orphan := range orphans {
+			reconciler.report(array.client.Addr, orphan)
+			if reconciler.gracePeriod > 0 && time.Since(orphan.firstSeen) >= reconciler.gracePeriod {
+				reconciler.delete(array.client, orphan)
+			}
+		}
+	}
+
+	return nil
+}
+
+// updateOwnership stores the cluster ID in the metadata of the volumes referenced by the persistent volumes
+// of the cluster which were created without it, and marks them as retained according to their reclaim policy
+func (reconciler *orphanReconciler) updateOwnership(client *arrayClient, volumes map[string]objectMetadata, handles map[string]v1.PersistentVolumeReclaimPolicy) {
+	for id, metadata := range volumes {
+		policy, ok := handles[id]
+		if !ok {
+			continue
+		}
+
+		cluster := metadata[clusterMetadataKey]
+		if cluster != "" && cluster != reconciler.clusterID {
+			klog.Warningf("volume %s is referenced by a persistent volume but belongs to cluster %s", id, cluster)
+			continue
+		}
+
+		retained := policy == v1.PersistentVolumeReclaimRetain
+		if cluster == reconciler.clusterID && (metadata[retainMetadataKey] == "true") == retained {
+			continue
+		}
+
+		updated := objectMetadata{}
+		for key, value := range metadata {
+			updated[key] = value
+		}
+		updated[clusterMetadataKey] = reconciler.clusterID
+		delete(updated, retainMetadataKey)
+		if retained {
+			updated[retainMetadataKey] = "true"
+		}
+
+		if !reconciler.controller.volumeLocks.TryLock(id) {
+			continue
+		}
+		err := setVolumeMetadata(client, id, updated)
+		reconciler.controller.volumeLocks.Unlock(id)
+		if err != nil {
+			klog.Errorf("could not update the metadata of volume %s: %v", id, err)
+			continue
+		}
+		volumes[id] = updated
+	}
+}
+
+// track updates the orphaned volumes of an array, and returns the ones which were already orphaned during the
+// previous reconciliation, as volumes being provisioned are not referenced by any persistent volume yet.
+// Volumes of other clusters, or whose persistent volume was retained, are never orphaned.
+func (reconciler *orphanReconciler) track(array string, volumes map[string]objectMetadata, handles map[string]v1.PersistentVolumeReclaimPolicy, now time.Time) []*orphanedVolume {
+	previous := reconciler.orphans[array]
+	current := map[string]*orphanedVolume{}
+	confirmed := []*orphanedVolume{}
+
+	for id, metadata := range volumes {
+		if _, ok := handles[id]; ok {
+			continue
+		}
+		if metadata[clusterMetadataKey] != reconciler.clusterID || metadata[retainMetadataKey] == "true" {
+			continue
+		}
+
+		if orphan, ok := previous[id]; ok {
+			current[id] = orphan
+			confirmed = append(confirmed, orphan)
+		} else {
+			current[id] = &orphanedVolume{id: id, metadata: metadata, firstSeen: now}
+		}
+	}
+
+	reconciler.orphans[array] = current
+	return confirmed
+}
+
+// report logs newly orphaned volumes, and records an event on the claim they were created for if it is known
+func (reconciler *orphanReconciler) report(array string, orphan *orphanedVolume) {
+	if orphan.reported {
+		return
+	}
+	orphan.reported = true
+
+	klog.Warningf("volume %s on array %s is not referenced by any persistent volume (%s)", orphan.id, array, orphan.metadata)
+
+	context := orphan.metadata.VolumeContext()
+	if context == nil {
+		return
+	}
+
+	reconciler.controller.recorder.Eventf(&v1.ObjectReference{
+		Kind:      "PersistentVolumeClaim",
+		Namespace: context[common.PVCNamespaceConfigKey],
+		Name:      context[common.PVCNameConfigKey],
+	}, v1.EventTypeWarning, "OrphanedVolume", "array volume %s is not referenced by any persistent volume", orphan.id)
+}
+
+func (reconciler *orphanReconciler) delete(client *arrayClient, orphan *orphanedVolume) {
+	if !reconciler.controller.volumeLocks.TryLock(orphan.id) {
+		klog.Infof("an operation is in progress on orphaned volume %s, not deleting it", orphan.id)
+		return
+	}
+	defer reconciler.controller.volumeLocks.Unlock(orphan.id)
+
+	hostNames, _, err := getVolumeMapsHostNames(client, orphan.id)
+	if err != nil {
+		klog.Errorf("could not get mappings of orphaned volume %s: %v", orphan.id, err)
+		return
+	}
+	if len(hostNames) > 0 {
+		klog.Warningf("orphaned volume %s is still mapped to %v, not deleting it", orphan.id, hostNames)
+		return
+	}
+
+	klog.Infof("deleting volume %s, orphaned since %s", orphan.id, orphan.firstSeen.Format(time.RFC3339))
+	_, _, err = client.DeleteVolume(orphan.id)
+	reconciler.controller.Collector().IncOrphanedVolumeDeleted(client.Addr, err == nil)
+	if err != nil {
+		klog.Errorf("could not delete orphaned volume %s: %v", orphan.id, err)
+		return
+	}
+
+	delete(reconciler.orphans[client.Addr], orphan.id)
+}
+
+// listDriverVolumes returns the metadata of the volumes created by the driver in the given pools,
+// leaving out the ones created from another cluster than the one with the given ID, if any
+func listDriverVolumes(client *arrayClient, pools []string, clusterID string) (map[string]objectMetadata, error) {
+	response, _, err := client.FormattedRequest("/show/volumes")
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := map[string]objectMetadata{}
+	for index := range response.Objects {
+		object := &response.Objects[index]
+		if isDriverVolume(object, pools, clusterID) {
+			volumes[getProperty(object, "volume-name")] = getVolumeMetadata(object)
+		}
+	}
+
+	return volumes, nil
+}
+
+// isDriverVolume reports whether the object is a volume created by the driver in one of the given pools,
+// and not from another cluster than the one with the given ID, if any
+func isDriverVolume(object *dothill.Object, pools []string, clusterID string) bool {
+	if !isBaseVolume(object, pools, clusterID) {
+		return false
+	}
+
+	metadata := getVolumeMetadata(object)
+	return metadata[hashMetadataKey] != "" || metadata[nameMetadataKey] != ""
+}
+
+// isBaseVolume reports whether the object is a volume in one of the given pools, rather than a snapshot, including the
+// volumes created before the driver stored metadata on them, but not the ones from another cluster than the given one
+func isBaseVolume(object *dothill.Object, pools []string, clusterID string) bool {
+	if object.Name != "volume" || getProperty(object, "volume-type") == "snapshot" {
+		return false
+	}
+	if !containsString(pools, getProperty(object, "storage-pool-name")) {
+		return false
+	}
+
+	cluster := getVolumeMetadata(object)[clusterMetadataKey]
+	return clusterID == "" || cluster == "" || cluster == clusterID
+}
@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/enix/dothill-api-go/v2"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+)
+
+func Test_orphanReconciler_track(t *testing.T) {
+	assert := assert.New(t)
+
+	reconciler := &orphanReconciler{clusterID: "prod", orphans: map[string]map[string]*orphanedVolume{}}
+	volumes := map[string]objectMetadata{
+		"pvc-a": {clusterMetadataKey: "prod"},
+		"pvc-b": {clusterMetadataKey: "prod"},
+		"pvc-c": {clusterMetadataKey: "staging"},
+		"pvc-d": {},
+		"pvc-e": {clusterMetadataKey: "prod", retainMetadataKey: "true"},
+	}
+	handles := map[string]v1.PersistentVolumeReclaimPolicy{"pvc-a": v1.PersistentVolumeReclaimDelete}
+	start := time.Now()
+
+	orphans := reconciler.track("array", volumes, handles, start)
+	assert.Empty(orphans, "volumes should not be orphaned until seen unreferenced twice")
+
+	orphans = reconciler.track("array", volumes, handles, start.Add(time.Minute))
+	assert.Len(orphans, 1, "volumes of other clusters or retained should not be orphaned")
+	assert.Equal("pvc-b", orphans[0].id)
+	assert.Equal(start, orphans[0].firstSeen)
+
+	handles["pvc-b"] = v1.PersistentVolumeReclaimDelete
+	orphans = reconciler.track("array", volumes, handles, start.Add(2*time.Minute))
+	assert.Empty(orphans)
+	assert.Empty(reconciler.orphans["array"], "referenced volumes should be forgotten")
+}
+
+func TestController_SetClusterID(t *testing.T) {
+	assert := assert.New(t)
+
+	controller := &Controller{}
+	assert.NoError(controller.SetClusterID("prod-eu.1"))
+	assert.Equal("prod-eu.1", controller.clusterID)
+	assert.Error(controller.SetClusterID(""))
+	assert.Error(controller.SetClusterID("prod eu"))
+}
+
+func Test_isDriverVolume(t *testing.T) {
+	assert := assert.New(t)
+
+	volume := func(volumeType, pool, description string) *dothill.Object {
+		object := newTestObject("volumes", map[string]string{
+			"volume-type":        volumeType,
+			"storage-pool-name":  pool,
+			"volume-description": description,
+		})
+		object.Name = "volume"
+		return &object
+	}
+	pools := []string{"A"}
+
+	assert.True(isDriverVolume(volume("base", "A", "hash=0123456789abcdef name=pvc-a"), pools, "prod"))
+	assert.True(isDriverVolume(volume("base", "A", "name=pvc-a cluster=prod"), pools, "prod"))
+	assert.False(isDriverVolume(volume("base", "A", "name=pvc-a cluster=staging"), pools, "prod"))
+	assert.True(isDriverVolume(volume("base", "A", "name=pvc-a cluster=staging"), pools, ""))
+	assert.False(isDriverVolume(volume("base", "B", "name=pvc-a"), pools, "prod"), "volumes of other pools should be left out")
+	assert.False(isDriverVolume(volume("snapshot", "A", "name=snapshot-a"), pools, "prod"), "snapshots should be left out")
+	assert.False(isDriverVolume(volume("base", "A", "manual volume"), pools, "prod"), "volumes without metadata should be left out")
+
+	assert.True(isBaseVolume(volume("base", "A", "manual volume"), pools, "prod"), "volumes without metadata should be listed")
+	assert.False(isBaseVolume(volume("base", "A", "name=pvc-a cluster=staging"), pools, "prod"))
+	assert.False(isBaseVolume(volume("snapshot", "A", ""), pools, "prod"))
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// Pool placement policies, used to choose a pool among the ones of a storage class
+const (
+	mostFreeSpacePlacement = "most-free-space"
+	roundRobinPlacement    = "round-robin"
+	fillFirstPlacement     = "fill-first"
+)
+
+var poolPlacements = []string{mostFreeSpacePlacement, roundRobinPlacement, fillFirstPlacement}
+
+// poolPlacer chooses the pool hosting each new volume
+type poolPlacer struct {
+	mutex    sync.Mutex
+	counters map[string]int
+}
+
+func newPoolPlacer() *poolPlacer {
+	return &poolPlacer{counters: map[string]int{}}
+}
+
+// getPoolNames returns the pools listed in the parameters, either in the 'pools' or the 'pool' parameter
+func getPoolNames(parameters map[string]string) []string {
+	names := []string{}
+	for _, name := range strings.Split(parameters[common.PoolsConfigKey], ",") {
+		if name = strings.TrimSpace(name); name != "" && !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 && parameters[common.PoolConfigKey] != "" {
+		names = append(names, parameters[common.PoolConfigKey])
+	}
+
+	return names
+}
+
+// getPoolPlacement returns the placement policy given in the parameters, defaulting to the most free space
+func getPoolPlacement(parameters map[string]string) string {
+	if placement := parameters[common.PoolPlacementConfigKey]; placement != "" {
+		return placement
+	}
+	return mostFreeSpacePlacement
+}
+
+// Choose returns the pool which should host a new volume of the given size, according to the placement policy
+func (placer *poolPlacer) Choose(client *arrayClient, names []string, placement string, size int64) (string, error) {
+	if len(names) == 1 {
+		return names[0], nil
+	}
+
+	if placement == roundRobinPlacement {
+		key := client.Addr + "/" + strings.Join(names, ",")
+
+		placer.mutex.Lock()
+		defer placer.mutex.Unlock()
+
+		name := names[placer.counters[key]%len(names)]
+		placer.counters[key]++
+		return name, nil
+	}
+
+	chosen, chosenSpace := "", int64(-1)
+	for _, name := range names {
+		pool, err := getPool(client, name)
+		if status.Code(err) == codes.NotFound {
+			klog.Warningf("pool %s not found, skipping it", name)
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		space, err := getPoolAvailableSpace(pool)
+		if err != nil {
+			return "", err
+		}
+		klog.V(2).Infof("pool %s has %d bytes available", name, space)
+
+		if placement == fillFirstPlacement && space >= size {
+			return name, nil
+		}
+		if placement == mostFreeSpacePlacement && space > chosenSpace {
+			chosen, chosenSpace = name, space
+		}
+	}
+
+	if chosen == "" {
+		return "", status.Errorf(codes.ResourceExhausted, "none of the pools %s can host a %d bytes volume", strings.Join(names, ", "), size)
+	}
+	return chosen, nil
+}
@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/enix/dothill-api-go/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_getPoolNames(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]string{"A"}, getPoolNames(map[string]string{"pool": "A"}))
+	assert.Equal([]string{"A", "B"}, getPoolNames(map[string]string{"pool": "C", "pools": "A, B,,A"}))
+	assert.Equal([]string{}, getPoolNames(map[string]string{}))
+}
+
+func Test_poolPlacer_Choose(t *testing.T) {
+	assert := assert.New(t)
+
+	placer := newPoolPlacer()
+	client := newArrayClient(&dothill.Client{Addr: "https://10.0.0.42"})
+
+	chosen := []string{}
+	for i := 0; i < 3; i++ {
+		name, err := placer.Choose(client, []string{"A", "B"}, roundRobinPlacement, 0)
+		assert.Nil(err)
+		chosen = append(chosen, name)
+	}
+	assert.Equal([]string{"A", "B", "A"}, chosen)
+
+	name, err := placer.Choose(client, []string{"C"}, mostFreeSpacePlacement, 0)
+	assert.Nil(err)
+	assert.Equal("C", name)
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"strings"
+
+	"github.com/enix/dothill-api-go/v2"
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// getTargetPortals returns the target IQN and the portals the node should connect to. Static parameters
+// take precedence over the values discovered from the array host ports, which are only queried if needed.
+func getTargetPortals(client *arrayClient, volumeContext map[string]string) (string, string, error) {
+	iqn := volumeContext[common.TargetIQNConfigKey]
+	portals := volumeContext[common.PortalsConfigKey]
+	if iqn != "" && portals != "" {
+		return iqn, portals, nil
+	}
+
+	response, _, err := client.FormattedRequest("/show/ports")
+	if err != nil {
+		return "", "", err
+	}
+
+	discoveredIQN, discoveredPortals := parseTargetPorts(response)
+	klog.V(2).Infof("discovered target %s on portals %v", discoveredIQN, discoveredPortals)
+
+	if iqn == "" {
+		if discoveredIQN == "" {
+			return "", "", status.Errorf(codes.Unavailable, "could not discover the target IQN from the array host ports, set the '%s' parameter", common.TargetIQNConfigKey)
+		}
+		iqn = discoveredIQN
+	}
+	if portals == "" {
+		if len(discoveredPortals) == 0 {
+			return "", "", status.Errorf(codes.Unavailable, "no iSCSI host port of the array is up, set the '%s' parameter", common.PortalsConfigKey)
+		}
+		portals = strings.Join(discoveredPortals, ",")
+	}
+
+	return iqn, portals, nil
+}
+
+// parseTargetPorts returns the target IQN and the addresses of the iSCSI host ports which are up
+func parseTargetPorts(response *dothill.Response) (string, []string) {
+	iqn := ""
+	portals := []string{}
+
+	for index := range response.Objects {
+		port := &response.Objects[index]
+		if port.Typ != "port" || !strings.EqualFold(getProperty(port, "port-type"), "iSCSI") {
+			continue
+		}
+
+		if iqn == "" {
+			iqn = getProperty(port, "target-id")
+		}
+		if !strings.EqualFold(getProperty(port, "status"), "Up") {
+			continue
+		}
+
+		for objectIndex := range port.Objects {
+			object := &port.Objects[objectIndex]
+			address := getProperty(object, "ip-address")
+			if object.Typ == "iscsi-port" && address != "" && address != "0.0.0.0" && !containsString(portals, address) {
+				portals = append(portals, address)
+			}
+		}
+	}
+
+	return iqn, portals
+}
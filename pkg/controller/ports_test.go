@@ -0,0 +1,36 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/enix/dothill-api-go/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestObject(typ string, properties map[string]string, objects ...dothill.Object) dothill.Object {
+	object := dothill.Object{Typ: typ, Objects: objects, PropertiesMap: map[string]*dothill.Property{}}
+	for name, value := range properties {
+		object.PropertiesMap[name] = &dothill.Property{Name: name, Data: value}
+	}
+	return object
+}
+
+func Test_parseTargetPorts(t *testing.T) {
+	assert := assert.New(t)
+
+	iqn := "iqn.2015-11.com.hpe:storage.msa2050.2002518b4c"
+	response := &dothill.Response{Objects: []dothill.Object{
+		newTestObject("port", map[string]string{"port-type": "iSCSI", "target-id": iqn, "status": "Up"},
+			newTestObject("iscsi-port", map[string]string{"ip-address": "10.0.0.24"})),
+		newTestObject("port", map[string]string{"port-type": "iSCSI", "target-id": iqn, "status": "Disconnected"},
+			newTestObject("iscsi-port", map[string]string{"ip-address": "10.0.0.25"})),
+		newTestObject("port", map[string]string{"port-type": "iSCSI", "target-id": iqn, "status": "Up"},
+			newTestObject("iscsi-port", map[string]string{"ip-address": "0.0.0.0"})),
+		newTestObject("port", map[string]string{"port-type": "FC", "target-id": "207000c0ff26ddd7", "status": "Up"}),
+		newTestObject("status", map[string]string{"response-type": "Success"}),
+	}}
+
+	discoveredIQN, portals := parseTargetPorts(response)
+	assert.Equal(iqn, discoveredIQN)
+	assert.Equal([]string{"10.0.0.24"}, portals)
+}
@@ -23,36 +23,51 @@ package controller
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"strconv"
-	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/enix/dothill-api-go/v2"
 	"github.com/enix/san-iscsi-csi/pkg/common"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog"
 )
 
-func (controller *Controller) checkVolumeExists(volumeID string, size int64) (bool, error) {
-	data, responseStatus, err := controller.dothillClient.ShowVolumes(volumeID)
-	if err != nil && responseStatus.ReturnCode != -10058 {
-		return false, err
+// getExistingVolume returns the volume with the given ID if it already exists, after checking it belongs to the request
+func getExistingVolume(client *arrayClient, volumeID string, name string) (*dothill.Object, error) {
+	object, err := getVolume(client, volumeID)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
 
-	for _, object := range data.Objects {
-		if object.Name == "volume" && object.PropertiesMap["volume-name"].Data == volumeID {
-			blocks, _ := strconv.ParseInt(object.PropertiesMap["blocks"].Data, 10, 64)
-			blocksize, _ := strconv.ParseInt(object.PropertiesMap["blocksize"].Data, 10, 64)
+	metadata := getVolumeMetadata(object)
+	if metadata.ConflictsWith(name) {
+		return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists for another volume request (%s)", volumeID, metadata[nameMetadataKey])
+	}
 
-			if blocks*blocksize == size {
-				return true, nil
-			}
-			return true, status.Error(codes.AlreadyExists, "cannot create volume with same name but different capacity than the existing one")
-		}
+	return object, nil
+}
+
+// getCloneSize returns the size of a volume cloned or restored from a source of the given size,
+// which may be larger than its source but never smaller
+func getCloneSize(capacityRange *csi.CapacityRange, sourceSize int64) (int64, error) {
+	if limit := capacityRange.GetLimitBytes(); limit > 0 && limit < sourceSize {
+		return 0, status.Errorf(codes.OutOfRange, "cannot create a volume limited to %d bytes from a %d bytes source", limit, sourceSize)
+	}
+
+	size := capacityRange.GetRequiredBytes()
+	if size == 0 {
+		return sourceSize, nil
+	}
+	if size < sourceSize {
+		return 0, status.Errorf(codes.OutOfRange, "cannot create a %d bytes volume from a larger %d bytes source", size, sourceSize)
 	}
 
-	return false, nil
+	return size, nil
 }
 
 // CreateVolume creates a new volume from the given request. The function is idempotent.
@@ -66,47 +81,107 @@ func (controller *Controller) CreateVolume(ctx context.Context, req *csi.CreateV
 	parameters := req.GetParameters()
 	klog.Infof("received %s volume request\n", sizeStr)
 
-	volumeID := req.GetName()
-	if len(volumeID) > common.VolumeNameMaxLength {
-		volumeID = volumeID[4:]
-		volumeID = strings.ReplaceAll(volumeID, "-", "")
-		volumeID = volumeID[:common.VolumeNameMaxLength]
+	volumeID := getVolumeID(req.GetName(), parameters[common.VolumePrefixConfigKey])
+
+	accessibleTopology, err := getAccessibleTopology(parameters[common.ArrayNameConfigKey], req.GetAccessibilityRequirements())
+	if err != nil {
+		return nil, err
+	}
+
+	client := getClient(ctx)
+
+	var sourceID string
+
+	if volume := req.VolumeContentSource.GetVolume(); volume != nil {
+		sourceID = volume.VolumeId
 	}
 
-	klog.Infof("creating volume %s (size %s) in pool %s", volumeID, sizeStr, parameters[common.PoolConfigKey])
+	if snapshot := req.VolumeContentSource.GetSnapshot(); sourceID == "" && snapshot != nil {
+		sourceID = snapshot.SnapshotId
+	}
+
+	if sourceID != "" {
+		source, err := getVolume(client, sourceID)
+		if err != nil {
+			return nil, err
+		}
+		if size, err = getCloneSize(req.GetCapacityRange(), getVolumeSize(source)); err != nil {
+			return nil, err
+		}
+		sizeStr = getSizeStr(size)
+
+		if err = checkVolumeCopied(client, volumeID); err != nil {
+			return nil, err
+		}
+	}
 
-	volumeExists, err := controller.checkVolumeExists(volumeID, size)
+	existingVolume, err := getExistingVolume(client, volumeID, req.GetName())
 	if err != nil {
 		return nil, err
 	}
 
-	if !volumeExists {
-		var sourceID string
-
-		if volume := req.VolumeContentSource.GetVolume(); volume != nil {
-			sourceID = volume.VolumeId
+	var poolName string
+	if existingVolume != nil {
+		// clones are expanded after the copy, so they may still be smaller than requested
+		existingSize := getVolumeSize(existingVolume)
+		if existingSize > size || (sourceID == "" && existingSize != size) {
+			return nil, status.Error(codes.AlreadyExists, "cannot create volume with same name but different capacity than the existing one")
 		}
 
-		if snapshot := req.VolumeContentSource.GetSnapshot(); sourceID == "" && snapshot != nil {
-			sourceID = snapshot.SnapshotId
+		poolName = getProperty(existingVolume, "storage-pool-name")
+		klog.Infof("volume %s already exists in pool %s", volumeID, poolName)
+	} else {
+		poolName, err = controller.pools.Choose(client, getPoolNames(parameters), getPoolPlacement(parameters), size)
+		if err != nil {
+			return nil, err
 		}
+		if err = checkPoolOvercommit(client, poolName, parameters); err != nil {
+			return nil, err
+		}
+
+		klog.Infof("creating volume %s (size %s) in pool %s", volumeID, sizeStr, poolName)
 
 		if sourceID != "" {
-			_, _, err = controller.dothillClient.CopyVolume(sourceID, volumeID, parameters[common.PoolConfigKey])
-		} else {
-			_, _, err = controller.dothillClient.CreateVolume(volumeID, sizeStr, parameters[common.PoolConfigKey])
+			if _, _, err = client.CopyVolume(sourceID, volumeID, poolName); err != nil {
+				return nil, err
+			}
+			if err = checkVolumeCopied(client, volumeID); err != nil {
+				return nil, err
+			}
+		} else if err = createVolume(client, volumeID, sizeStr, poolName, parameters); err != nil {
+			return nil, err
 		}
-		if err != nil {
+	}
+
+	if sourceID != "" {
+		if err = expandVolume(client, volumeID, size); err != nil {
 			return nil, err
 		}
 	}
 
+	if err = applyVolumeAttributes(client, volumeID, parameters); err != nil {
+		return nil, err
+	}
+
+	metadata := getVolumeCreationMetadata(req.GetName(), parameters)
+	controller.setOwnershipMetadata(ctx, metadata, parameters)
+	if err = setVolumeMetadata(client, volumeID, metadata); err != nil {
+		return nil, err
+	}
+
+	volumeContext := map[string]string{}
+	for key, value := range parameters {
+		volumeContext[key] = value
+	}
+	volumeContext[common.PoolConfigKey] = poolName
+
 	volume := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      volumeID,
-			VolumeContext: parameters,
-			CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
-			ContentSource: req.GetVolumeContentSource(),
+			VolumeId:           volumeID,
+			VolumeContext:      volumeContext,
+			CapacityBytes:      size,
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: accessibleTopology,
 		},
 	}
 
@@ -122,7 +197,7 @@ func (controller *Controller) DeleteVolume(ctx context.Context, req *csi.DeleteV
 	}
 
 	klog.Infof("deleting volume %s", req.GetVolumeId())
-	_, respStatus, err := controller.dothillClient.DeleteVolume(req.GetVolumeId())
+	_, respStatus, err := getClient(ctx).DeleteVolume(req.GetVolumeId())
 	if err != nil {
 		if respStatus != nil {
 			if respStatus.ReturnCode == volumeNotFoundErrorCode {
@@ -139,6 +214,25 @@ func (controller *Controller) DeleteVolume(ctx context.Context, req *csi.DeleteV
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// getVolumeID returns the name of the array volume backing the volume with the given name
+func getVolumeID(name string, prefix string) string {
+	return getObjectID(name, prefix, common.DefaultVolumePrefix)
+}
+
+// getObjectID returns the name given to the array object created for a CSI object, which is the
+// CSI object name itself if the array accepts it, or a prefix followed by a hash of the name otherwise
+func getObjectID(name string, prefix string, defaultPrefix string) string {
+	if len(name) <= common.VolumeNameMaxLength && !unsafeCharacters.MatchString(name) {
+		return name
+	}
+
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	hash := sha256.Sum256([]byte(name))
+	return prefix + "_" + hex.EncodeToString(hash[:])[:common.VolumeNameMaxLength-len(prefix)-1]
+}
+
 func getSizeStr(size int64) string {
 	if size == 0 {
 		size = 4096
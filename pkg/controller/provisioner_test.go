@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_getVolumeID(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("short-name", getVolumeID("short-name", ""), "names fitting on the array should be kept as is")
+	assert.NotEqual("short,name", getVolumeID("short,name", ""), "names with unsafe characters should be replaced")
+
+	name := "pvc-0a1b2c3d-4e5f-6a7b-8c9d-0e1f2a3b4c5d"
+	volumeID := getVolumeID(name, "")
+	assert.Equal(volumeID, getVolumeID(name, ""), "volume IDs should be deterministic")
+	assert.LessOrEqual(len(volumeID), common.VolumeNameMaxLength)
+	assert.True(strings.HasPrefix(volumeID, common.DefaultVolumePrefix+"_"))
+
+	// these names collided with the previous truncation based derivation
+	assert.NotEqual(
+		getVolumeID("pvc-0a1b2c3d-4e5f-6a7b-8c9d-0e1f2a3b4c5d", ""),
+		getVolumeID("pvc-0a1b2c3d-4e5f-6a7b-8c9d-0e1f2a3b4c5e", ""),
+	)
+
+	prefixedVolumeID := getVolumeID(name, "k8s")
+	assert.LessOrEqual(len(prefixedVolumeID), common.VolumeNameMaxLength)
+	assert.True(strings.HasPrefix(prefixedVolumeID, "k8s_"))
+}
+
+func Test_getSnapshotID(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("snap", getSnapshotID("snap"), "names fitting on the array should be kept as is")
+
+	snapshotID := getSnapshotID("snapshot-0a1b2c3d-4e5f-6a7b-8c9d-0e1f2a3b4c5d")
+	assert.LessOrEqual(len(snapshotID), common.VolumeNameMaxLength)
+	assert.True(strings.HasPrefix(snapshotID, common.DefaultSnapshotPrefix+"_"))
+}
+
+func Test_getCloneSize(t *testing.T) {
+	assert := assert.New(t)
+
+	size, err := getCloneSize(nil, 1024)
+	assert.Nil(err)
+	assert.Equal(int64(1024), size, "clones should default to the size of their source")
+
+	size, err = getCloneSize(&csi.CapacityRange{RequiredBytes: 4096}, 1024)
+	assert.Nil(err)
+	assert.Equal(int64(4096), size, "clones may be larger than their source")
+
+	_, err = getCloneSize(&csi.CapacityRange{RequiredBytes: 512}, 1024)
+	assert.Equal(codes.OutOfRange, status.Code(err), "clones cannot be smaller than their source")
+
+	_, err = getCloneSize(&csi.CapacityRange{LimitBytes: 512}, 1024)
+	assert.Equal(codes.OutOfRange, status.Code(err), "clones cannot be limited below the size of their source")
+}
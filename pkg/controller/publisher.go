@@ -36,30 +36,88 @@ import (
 	"k8s.io/klog"
 )
 
-func getVolumeMapsHostNames(client *dothill.Client, name string) ([]string, *dothill.ResponseStatus, error) {
+// readOnlyAccess is the access reported by the array for read-only host mappings
+const readOnlyAccess = "read-only"
+
+// volumeMap is a mapping of a volume to a host, as reported by the array
+type volumeMap struct {
+	HostName string
+	Access   string
+}
+
+func getVolumeMaps(client *arrayClient, name string) ([]volumeMap, *dothill.ResponseStatus, error) {
 	if name != "" {
 		name = fmt.Sprintf("\"%s\"", name)
 	}
 	res, status, err := client.Request(fmt.Sprintf("/show/volume-maps/%s", name))
 	if err != nil {
-		return []string{}, status, err
+		return []volumeMap{}, status, err
 	}
 
-	hostNames := []string{}
-	for _, rootObj := range res.Objects {
+	volumeMaps := []volumeMap{}
+	for _, maps := range parseVolumeMaps(res) {
+		volumeMaps = append(volumeMaps, maps...)
+	}
+
+	return volumeMaps, status, err
+}
+
+func getAllVolumeMaps(client *arrayClient) (map[string][]volumeMap, *dothill.ResponseStatus, error) {
+	res, status, err := client.Request("/show/volume-maps")
+	if err != nil {
+		return map[string][]volumeMap{}, status, err
+	}
+
+	return parseVolumeMaps(res), status, err
+}
+
+func getVolumeMapsHostNames(client *arrayClient, name string) ([]string, *dothill.ResponseStatus, error) {
+	volumeMaps, status, err := getVolumeMaps(client, name)
+	return getHostNames(volumeMaps), status, err
+}
+
+func getAllVolumeMapsHostNames(client *arrayClient) (map[string][]string, *dothill.ResponseStatus, error) {
+	allVolumeMaps, status, err := getAllVolumeMaps(client)
+
+	hostNames := map[string][]string{}
+	for volumeName, volumeMaps := range allVolumeMaps {
+		hostNames[volumeName] = getHostNames(volumeMaps)
+	}
+
+	return hostNames, status, err
+}
+
+// parseVolumeMaps returns the host mappings of each volume, indexed by volume name
+func parseVolumeMaps(res *dothill.Response) map[string][]volumeMap {
+	volumeMaps := map[string][]volumeMap{}
+	for index := range res.Objects {
+		rootObj := &res.Objects[index]
 		if rootObj.Name != "volume-view" {
 			continue
 		}
 
-		for _, object := range rootObj.Objects {
-			hostName := object.PropertiesMap["identifier"].Data
+		volumeName := getProperty(rootObj, "volume-name")
+		for objectIndex := range rootObj.Objects {
+			object := &rootObj.Objects[objectIndex]
+			hostName := getProperty(object, "identifier")
 			if object.Name == "host-view" && hostName != "all other hosts" {
-				hostNames = append(hostNames, hostName)
+				volumeMaps[volumeName] = append(volumeMaps[volumeName], volumeMap{
+					HostName: hostName,
+					Access:   getProperty(object, "access"),
+				})
 			}
 		}
 	}
 
-	return hostNames, status, err
+	return volumeMaps
+}
+
+func getHostNames(volumeMaps []volumeMap) []string {
+	hostNames := []string{}
+	for _, volumeMap := range volumeMaps {
+		hostNames = append(hostNames, volumeMap.HostName)
+	}
+	return hostNames
 }
 
 // ControllerPublishVolume attaches the given volume to the node
@@ -75,31 +133,71 @@ func (driver *Controller) ControllerPublishVolume(ctx context.Context, req *csi.
 	}
 
 	initiatorName := req.GetNodeId()
-	klog.Infof("attach request for initiator %s, volume id: %s", initiatorName, req.GetVolumeId())
+	readOnly := req.GetReadonly() || req.GetVolumeCapability().GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+	klog.Infof("attach request for initiator %s, volume id: %s, read-only: %t", initiatorName, req.GetVolumeId(), readOnly)
 
-	hostNames, _, err := getVolumeMapsHostNames(driver.dothillClient, req.GetVolumeId())
+	client := getClient(ctx)
+	volumeMaps, _, err := getVolumeMaps(client, req.GetVolumeId())
 	if err != nil {
 		return nil, err
 	}
-	for _, hostName := range hostNames {
-		if hostName != initiatorName {
+	conflictingInitiators := []string{}
+	for _, volumeMap := range volumeMaps {
+		if volumeMap.HostName != initiatorName && !(readOnly && volumeMap.Access == readOnlyAccess) {
+			conflictingInitiators = append(conflictingInitiators, volumeMap.HostName)
+		}
+	}
+	if len(conflictingInitiators) > 0 {
+		if !driver.fencing {
 			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is already attached to another node", req.GetVolumeId())
 		}
+		if err = driver.fenceInitiators(ctx, client, req.GetVolumeId(), conflictingInitiators); err != nil {
+			return nil, err
+		}
+	}
+
+	iqn, portals, err := getTargetPortals(client, req.GetVolumeContext())
+	if err != nil {
+		return nil, err
 	}
 
-	lun, err := driver.chooseLUN(initiatorName)
+	// CHAP secrets are read from the node publish secret, so that the kubelet is not given the array credentials
+	chapSecrets, err := driver.getNodePublishSecrets(ctx, req.GetVolumeId(), req.GetVolumeContext())
+	if err != nil {
+		return nil, err
+	}
+
+	// CHAP records and LUN allocation must be serialized per initiator, or concurrent publications could overwrite
+	// each other's records, or map two volumes on the same LUN
+	driver.initiatorLocks.Lock(initiatorName)
+	defer driver.initiatorLocks.Unlock(initiatorName)
+
+	if err = driver.ensureChapRecord(client, initiatorName, iqn, chapSecrets); err != nil {
+		return nil, err
+	}
+
+	lun, err := chooseLUN(client, initiatorName)
 	if err != nil {
 		return nil, err
 	}
 	klog.Infof("using LUN %d", lun)
 
-	if err = driver.mapVolume(req.GetVolumeId(), initiatorName, lun); err != nil {
+	access := "rw"
+	if readOnly {
+		access = "ro"
+	}
+
+	if err = mapVolume(client, req.GetVolumeId(), initiatorName, lun, access); err != nil {
 		return nil, err
 	}
 
 	klog.Infof("successfully mapped volume %s for initiator %s", req.GetVolumeId(), initiatorName)
 	return &csi.ControllerPublishVolumeResponse{
-		PublishContext: map[string]string{"lun": strconv.Itoa(lun)},
+		PublishContext: map[string]string{
+			"lun":                     strconv.Itoa(lun),
+			common.TargetIQNConfigKey: iqn,
+			common.PortalsConfigKey:   portals,
+		},
 	}, nil
 }
 
@@ -110,7 +208,7 @@ func (driver *Controller) ControllerUnpublishVolume(ctx context.Context, req *cs
 	}
 
 	klog.Infof("unmapping volume %s from initiator %s", req.GetVolumeId(), req.GetNodeId())
-	_, status, err := driver.dothillClient.UnmapVolume(req.GetVolumeId(), req.GetNodeId())
+	_, status, err := getClient(ctx).UnmapVolume(req.GetVolumeId(), req.GetNodeId())
 	if err != nil {
 		if status != nil && status.ReturnCode == unmapFailedErrorCode {
 			klog.Info("unmap failed, assuming volume is already unmapped")
@@ -124,9 +222,9 @@ func (driver *Controller) ControllerUnpublishVolume(ctx context.Context, req *cs
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
-func (driver *Controller) chooseLUN(initiatorName string) (int, error) {
+func chooseLUN(client *arrayClient, initiatorName string) (int, error) {
 	klog.Infof("listing all LUN mappings")
-	volumes, responseStatus, err := driver.dothillClient.ShowHostMaps(initiatorName)
+	volumes, responseStatus, err := client.ShowHostMaps(initiatorName)
 	if err != nil && responseStatus == nil {
 		return -1, err
 	}
@@ -160,9 +258,9 @@ func (driver *Controller) chooseLUN(initiatorName string) (int, error) {
 	return -1, status.Error(codes.ResourceExhausted, "no more available LUNs")
 }
 
-func (driver *Controller) mapVolume(volumeName, initiatorName string, lun int) error {
-	klog.Infof("trying to map volume %s for initiator %s on LUN %d", volumeName, initiatorName, lun)
-	_, metadata, err := driver.dothillClient.MapVolume(volumeName, initiatorName, "rw", lun)
+func mapVolume(client *arrayClient, volumeName, initiatorName string, lun int, access string) error {
+	klog.Infof("trying to map volume %s for initiator %s on LUN %d (%s)", volumeName, initiatorName, lun, access)
+	_, metadata, err := client.MapVolume(volumeName, initiatorName, access, lun)
 	if err != nil && metadata == nil {
 		return err
 	}
@@ -174,12 +272,12 @@ func (driver *Controller) mapVolume(volumeName, initiatorName string, lun int) e
 
 		nodeName := strings.Join(nodeIDParts[1:], ":")
 		klog.Infof("initiator does not exist, creating it with nickname %s", nodeName)
-		_, _, err = driver.dothillClient.CreateHost(nodeName, initiatorName)
+		_, _, err = client.CreateHost(nodeName, initiatorName)
 		if err != nil {
 			return err
 		}
 		klog.Info("retrying to map volume")
-		_, _, err = driver.dothillClient.MapVolume(volumeName, initiatorName, "rw", lun)
+		_, _, err = client.MapVolume(volumeName, initiatorName, access, lun)
 		if err != nil {
 			return err
 		}
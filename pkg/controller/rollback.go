@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// ServeRollback serves the volume rollback endpoint on the given address, authenticating requests
+// with the given token. It never returns.
+func (controller *Controller) ServeRollback(address string, token string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rollback", authenticateRollback(token, controller.handleRollback))
+
+	klog.Infof("serving volume rollback endpoint on %s", address)
+	klog.Fatal(http.ListenAndServe(address, mux))
+}
+
+func authenticateRollback(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !common.IsAuthorized(r, token) {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// handleRollback reverts the volume given in the request to the given snapshot
+func (controller *Controller) handleRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	volumeID := r.FormValue("volume")
+	snapshotID := r.FormValue("snapshot")
+	if volumeID == "" || snapshotID == "" {
+		http.Error(w, "both volume and snapshot parameters are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := controller.RollbackVolume(r.Context(), volumeID, snapshotID); err != nil {
+		klog.Errorf("could not roll back volume %s to snapshot %s: %v", volumeID, snapshotID, err)
+		http.Error(w, status.Convert(err).Message(), getHTTPStatus(err))
+		return
+	}
+
+	fmt.Fprintf(w, "volume %s rolled back to snapshot %s\n", volumeID, snapshotID)
+}
+
+// RollbackVolume reverts the given volume in place to one of its snapshots, which is only allowed
+// while the volume is not mapped to any host since its content changes underneath the filesystem
+func (controller *Controller) RollbackVolume(ctx context.Context, volumeID string, snapshotID string) error {
+	if !controller.volumeLocks.TryLock(volumeID) {
+		return status.Errorf(codes.Aborted, "an operation is already in progress on volume %s", volumeID)
+	}
+	defer controller.volumeLocks.Unlock(volumeID)
+
+	client, err := controller.findSnapshotArray(ctx, snapshotID)
+	if err != nil {
+		return err
+	}
+
+	response, _, err := client.ShowSnapshots(snapshotID)
+	if err != nil {
+		return err
+	}
+	snapshots, err := getSnapshotsFromResponse(response, snapshotID, "")
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		return status.Errorf(codes.NotFound, "snapshot %s not found", snapshotID)
+	}
+	if sourceVolumeID := snapshots[0].Snapshot.SourceVolumeId; sourceVolumeID != volumeID {
+		return status.Errorf(codes.InvalidArgument, "snapshot %s is a snapshot of volume %s, not %s", snapshotID, sourceVolumeID, volumeID)
+	}
+
+	hostNames, _, err := getVolumeMapsHostNames(client, volumeID)
+	if err != nil {
+		return err
+	}
+	if len(hostNames) > 0 {
+		return status.Errorf(codes.FailedPrecondition, "volume %s is still mapped to %v, refusing to roll it back", volumeID, hostNames)
+	}
+
+	klog.Infof("rolling back volume %s to snapshot %s", volumeID, snapshotID)
+	if _, _, err = client.FormattedRequest("/rollback/volume/snapshot/%q/%q", snapshotID, volumeID); err != nil {
+		return err
+	}
+
+	klog.Infof("volume %s successfully rolled back to snapshot %s", volumeID, snapshotID)
+	return nil
+}
+
+// findSnapshotArray returns the client of the array, among the ones used by the storage classes, holding the given snapshot
+func (controller *Controller) findSnapshotArray(ctx context.Context, snapshotID string) (*arrayClient, error) {
+	arrays, err := controller.getStorageClassArrays(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, array := range arrays {
+		_, err := getVolume(array.client, snapshotID)
+		if status.Code(err) == codes.NotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return array.client, nil
+	}
+
+	return nil, status.Errorf(codes.NotFound, "snapshot %s not found", snapshotID)
+}
+
+// getHTTPStatus returns the HTTP status matching the gRPC status of the given error
+func getHTTPStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.FailedPrecondition, codes.Aborted:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_handleRollback(t *testing.T) {
+	assert := assert.New(t)
+	controller := &Controller{}
+
+	recorder := httptest.NewRecorder()
+	controller.handleRollback(recorder, httptest.NewRequest(http.MethodGet, "/rollback?volume=pvc-a&snapshot=snap-a", nil))
+	assert.Equal(http.StatusMethodNotAllowed, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	controller.handleRollback(recorder, httptest.NewRequest(http.MethodPost, "/rollback?volume=pvc-a", nil))
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+}
+
+func Test_authenticateRollback(t *testing.T) {
+	assert := assert.New(t)
+	handler := authenticateRollback("s3cr3t", func(w http.ResponseWriter, r *http.Request) {})
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodPost, "/rollback?volume=pvc-a&snapshot=snap-a", nil))
+	assert.Equal(http.StatusUnauthorized, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/rollback?volume=pvc-a&snapshot=snap-a", nil)
+	request.Header.Set("Authorization", "Bearer wrong")
+	handler(recorder, request)
+	assert.Equal(http.StatusUnauthorized, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	request.Header.Set("Authorization", "Bearer s3cr3t")
+	handler(recorder, request)
+	assert.Equal(http.StatusOK, recorder.Code)
+}
+
+func Test_getHTTPStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(http.StatusConflict, getHTTPStatus(status.Error(codes.FailedPrecondition, "volume is mapped")))
+	assert.Equal(http.StatusNotFound, getHTTPStatus(status.Error(codes.NotFound, "snapshot not found")))
+	assert.Equal(http.StatusInternalServerError, getHTTPStatus(errors.New("array unreachable")))
+}
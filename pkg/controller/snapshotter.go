@@ -25,12 +25,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/enix/dothill-api-go/v2"
+	"github.com/enix/san-iscsi-csi/pkg/common"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/timestamp"
 	"google.golang.org/grpc/codes"
@@ -40,14 +41,45 @@ import (
 
 // CreateSnapshot creates a snapshot of the given volume
 func (controller *Controller) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	name := strings.Replace(req.Name[9:], "-", "", -1)
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "cannot create snapshot with empty name")
+	}
+	if req.GetSourceVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "cannot create snapshot without source volume ID")
+	}
 
-	_, respStatus, err := controller.dothillClient.CreateSnapshot(req.SourceVolumeId, name)
-	if err != nil && respStatus.ReturnCode != snapshotAlreadyExists {
+	fsFreezeTimeout, err := getFsFreezeTimeout(req.GetParameters())
+	if err != nil {
 		return nil, err
 	}
 
-	response, _, err := controller.dothillClient.ShowSnapshots(name)
+	client := getClient(ctx)
+	name := getSnapshotID(req.GetName())
+	klog.Infof("creating snapshot %s of volume %s", name, req.GetSourceVolumeId())
+
+	createSnapshot := func() error {
+		_, respStatus, err := client.CreateSnapshot(req.GetSourceVolumeId(), name)
+		if err != nil && (respStatus == nil || respStatus.ReturnCode != snapshotAlreadyExists) {
+			return err
+		}
+		return nil
+	}
+
+	if fsFreezeTimeout == 0 {
+		err = createSnapshot()
+	} else if _, err = getVolume(client, name); status.Code(err) == codes.NotFound {
+		err = controller.withFrozenVolume(ctx, client, req.GetSourceVolumeId(), fsFreezeTimeout, createSnapshot)
+		if status.Code(err) == codes.DeadlineExceeded {
+			// the filesystem may have been thawed before the snapshot was taken, which is thus not consistent
+			klog.Warningf("deleting snapshot %s taken after the filesystem was thawed", name)
+			client.DeleteSnapshot(name)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	response, _, err := client.ShowSnapshots(name)
 	if err != nil {
 		return nil, err
 	}
@@ -68,8 +100,20 @@ func (controller *Controller) CreateSnapshot(ctx context.Context, req *csi.Creat
 		return nil, errors.New("snapshot not found")
 	}
 
-	if snapshot.SourceVolumeId != req.SourceVolumeId {
-		return nil, status.Error(codes.AlreadyExists, "cannot validate volume with empty ID")
+	if snapshot.SourceVolumeId != req.GetSourceVolumeId() {
+		return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists with a different source volume (%s)", name, snapshot.SourceVolumeId)
+	}
+
+	object, err := getVolume(client, name)
+	if err != nil {
+		return nil, err
+	}
+	metadata := getVolumeMetadata(object)
+	if metadata.ConflictsWith(req.GetName()) {
+		return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for another snapshot request (%s)", name, metadata[nameMetadataKey])
+	}
+	if err = setVolumeMetadata(client, name, metadata.SetName(req.GetName())); err != nil {
+		return nil, err
 	}
 
 	return &csi.CreateSnapshotResponse{Snapshot: snapshot}, nil
@@ -77,7 +121,11 @@ func (controller *Controller) CreateSnapshot(ctx context.Context, req *csi.Creat
 
 // DeleteSnapshot deletes a snapshot of the given volume
 func (controller *Controller) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	_, status, err := controller.dothillClient.DeleteSnapshot(req.SnapshotId)
+	if req.GetSnapshotId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "cannot delete snapshot with empty ID")
+	}
+
+	_, status, err := getClient(ctx).DeleteSnapshot(req.SnapshotId)
 	if err != nil {
 		if status != nil && status.ReturnCode == snapshotNotFoundErrorCode {
 			klog.Infof("snapshot %s does not exist, assuming it has already been deleted", req.SnapshotId)
@@ -90,30 +138,76 @@ func (controller *Controller) DeleteSnapshot(ctx context.Context, req *csi.Delet
 
 // ListSnapshots list existing snapshots
 func (controller *Controller) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	response, _, err := controller.dothillClient.ShowSnapshots()
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "cannot list snapshots with a negative max entries count")
+	}
+
+	// the array only filters snapshots by name, snapshots of a given volume are filtered afterwards
+	var names []string
+	if req.GetSnapshotId() != "" {
+		names = append(names, req.GetSnapshotId())
+	}
+
+	response, respStatus, err := getClient(ctx).ShowSnapshots(names...)
+	if err != nil {
+		if len(names) > 0 && respStatus != nil &&
+			(respStatus.ReturnCode == snapshotNotFoundErrorCode || respStatus.ReturnCode == volumeShowNotFoundErrorCode) {
+			klog.Infof("snapshot %s does not exist", req.GetSnapshotId())
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		return nil, err
+	}
+
+	snapshots, err := getSnapshotsFromResponse(response, req.GetSnapshotId(), req.GetSourceVolumeId())
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, nextToken, err := paginate(len(snapshots), req.GetStartingToken(), req.GetMaxEntries())
 	if err != nil {
 		return nil, err
 	}
+	klog.V(2).Infof("listing snapshots %d to %d out of %d", start, end, len(snapshots))
 
+	return &csi.ListSnapshotsResponse{
+		Entries:   snapshots[start:end],
+		NextToken: nextToken,
+	}, nil
+}
+
+// getSnapshotsFromResponse returns the snapshots of the response matching the given snapshot and source volume IDs if any,
+// sorted by ID so that pagination tokens remain stable across calls
+func getSnapshotsFromResponse(response *dothill.Response, snapshotID string, sourceVolumeID string) ([]*csi.ListSnapshotsResponse_Entry, error) {
 	snapshots := []*csi.ListSnapshotsResponse_Entry{}
-	for _, object := range response.Objects {
+	for index := range response.Objects {
+		object := &response.Objects[index]
 		if object.Typ != "snapshots" {
 			continue
 		}
 
-		snapshot, err := newSnapshotFromResponse(&object)
+		snapshot, err := newSnapshotFromResponse(object)
 		if err != nil {
 			return nil, err
 		}
+		if (snapshotID != "" && snapshot.SnapshotId != snapshotID) ||
+			(sourceVolumeID != "" && snapshot.SourceVolumeId != sourceVolumeID) {
+			continue
+		}
 
 		snapshots = append(snapshots, &csi.ListSnapshotsResponse_Entry{
 			Snapshot: snapshot,
 		})
 	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Snapshot.SnapshotId < snapshots[j].Snapshot.SnapshotId
+	})
 
-	return &csi.ListSnapshotsResponse{
-		Entries: snapshots,
-	}, nil
+	return snapshots, nil
+}
+
+// getSnapshotID returns the name of the array snapshot backing the snapshot with the given name
+func getSnapshotID(name string) string {
+	return getObjectID(name, "", common.DefaultSnapshotPrefix)
 }
 
 func newSnapshotFromResponse(object *dothill.Object) (*csi.Snapshot, error) {
@@ -132,7 +226,7 @@ func newSnapshotFromResponse(object *dothill.Object) (*csi.Snapshot, error) {
 		SnapshotId:     snapshotId,
 		SourceVolumeId: sourceVolumeId,
 		CreationTime:   creationTime,
-		ReadyToUse:     true,
+		ReadyToUse:     isSnapshotReady(object),
 	}, nil
 }
 
@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/enix/dothill-api-go/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_getSnapshotsFromResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	newSnapshot := func(name string, volume string) dothill.Object {
+		return newTestObject("snapshots", map[string]string{
+			"name":                       name,
+			"master-volume-name":         volume,
+			"total-size-numeric":         "1024",
+			"creation-date-time-numeric": "1600000000",
+		})
+	}
+	response := &dothill.Response{Objects: []dothill.Object{
+		newSnapshot("snap-c", "pvc-a"),
+		newSnapshot("snap-a", "pvc-a"),
+		newSnapshot("snap-b", "pvc-b"),
+		newTestObject("status", map[string]string{"response-type": "Success"}),
+	}}
+
+	ids := func(snapshotID string, sourceVolumeID string) []string {
+		snapshots, err := getSnapshotsFromResponse(response, snapshotID, sourceVolumeID)
+		assert.Nil(err)
+		ids := []string{}
+		for _, entry := range snapshots {
+			ids = append(ids, entry.Snapshot.SnapshotId)
+		}
+		return ids
+	}
+
+	assert.Equal([]string{"snap-a", "snap-b", "snap-c"}, ids("", ""), "snapshots should be sorted by ID")
+	assert.Equal([]string{"snap-a", "snap-c"}, ids("", "pvc-a"))
+	assert.Equal([]string{"snap-b"}, ids("snap-b", ""))
+	assert.Equal([]string{}, ids("snap-b", "pvc-a"))
+	assert.Equal([]string{}, ids("snap-d", ""))
+}
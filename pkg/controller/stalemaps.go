@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// staleVolumeMap is a mapping of a volume created by the driver to a host, which is not justified by any volume attachment
+type staleVolumeMap struct {
+	volumeID  string
+	initiator string
+}
+
+// RunStaleMapsReconciler periodically removes the mappings of the volumes created by the driver which are not
+// justified by any volume attachment, or only reports them in dry-run mode. It returns once the context is done.
+func (controller *Controller) RunStaleMapsReconciler(ctx context.Context, interval time.Duration, dryRun bool) {
+	klog.Infof("starting stale volume maps reconciler (interval %s, dry-run %t)", interval, dryRun)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := controller.reconcileStaleMaps(ctx, dryRun); err != nil {
+			klog.Errorf("could not reconcile stale volume maps: %v", err)
+		}
+	}, interval)
+}
+
+func (controller *Controller) reconcileStaleMaps(ctx context.Context, dryRun bool) error {
+	arrays, err := controller.getStorageClassArrays(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, array := range arrays {
+		volumes, err := listDriverVolumes(array.client, array.pools, controller.clusterID)
+		if err != nil {
+			klog.Errorf("could not list volumes of array %s: %v", array.client.Addr, err)
+			continue
+		}
+
+		volumeMaps, _, err := getAllVolumeMaps(array.client)
+		if err != nil {
+			klog.Errorf("could not list volume maps of array %s: %v", array.client.Addr, err)
+			continue
+		}
+
+		// volume attachments are listed after volume maps, so that volumes being published are found
+		attachments, err := controller.getVolumeAttachments(ctx)
+		if err != nil {
+			return err
+		}
+
+		staleMaps := findStaleVolumeMaps(volumes, volumeMaps, attachments)
+		controller.Collector().SetStaleVolumeMaps(array.client.Addr, len(staleMaps))
+
+		for _, staleMap := range staleMaps {
+			if dryRun {
+				klog.Warningf("volume %s is mapped to %s without any volume attachment, dry-run enabled, not unmapping it", staleMap.volumeID, staleMap.initiator)
+				continue
+			}
+			controller.removeStaleVolumeMap(array.client, staleMap)
+		}
+	}
+
+	return nil
+}
+
+// findStaleVolumeMaps returns the mappings of the given volumes which are not justified by the attachments
+func findStaleVolumeMaps(volumes map[string]objectMetadata, volumeMaps map[string][]volumeMap, attachments map[string][]string) []staleVolumeMap {
+	staleMaps := []staleVolumeMap{}
+	for volumeID, maps := range volumeMaps {
+		if _, ok := volumes[volumeID]; !ok || containsString(attachments[volumeID], anyNode) {
+			continue
+		}
+
+		for _, volumeMap := range maps {
+			if !containsString(attachments[volumeID], volumeMap.HostName) {
+				staleMaps = append(staleMaps, staleVolumeMap{volumeID: volumeID, initiator: volumeMap.HostName})
+			}
+		}
+	}
+
+	sort.Slice(staleMaps, func(i, j int) bool {
+		if staleMaps[i].volumeID != staleMaps[j].volumeID {
+			return staleMaps[i].volumeID < staleMaps[j].volumeID
+		}
+		return staleMaps[i].initiator < staleMaps[j].initiator
+	})
+	return staleMaps
+}
+
+func (controller *Controller) removeStaleVolumeMap(client *arrayClient, staleMap staleVolumeMap) {
+	if !controller.volumeLocks.TryLock(staleMap.volumeID) {
+		klog.Infof("an operation is in progress on volume %s, not unmapping it", staleMap.volumeID)
+		return
+	}
+	defer controller.volumeLocks.Unlock(staleMap.volumeID)
+
+	klog.Infof("unmapping volume %s from %s, which is not justified by any volume attachment", staleMap.volumeID, staleMap.initiator)
+	_, responseStatus, err := client.UnmapVolume(staleMap.volumeID, staleMap.initiator)
+	if err != nil && responseStatus != nil && responseStatus.ReturnCode == unmapFailedErrorCode {
+		klog.Infof("volume %s is already unmapped from %s", staleMap.volumeID, staleMap.initiator)
+		err = nil
+	}
+
+	controller.Collector().IncStaleVolumeMapRemoved(client.Addr, err == nil)
+	if err != nil {
+		klog.Errorf("could not unmap volume %s from %s: %v", staleMap.volumeID, staleMap.initiator, err)
+	}
+}
@@ -0,0 +1,28 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_findStaleVolumeMaps(t *testing.T) {
+	assert := assert.New(t)
+
+	volumes := map[string]objectMetadata{"pvc-a": {}, "pvc-b": {}, "pvc-c": {}}
+	volumeMaps := map[string][]volumeMap{
+		"pvc-a":  {{HostName: "iqn.node-1"}, {HostName: "iqn.node-2"}},
+		"pvc-b":  {{HostName: "iqn.node-1"}},
+		"pvc-c":  {{HostName: "iqn.node-3"}},
+		"manual": {{HostName: "iqn.node-1"}},
+	}
+	attachments := map[string][]string{
+		"pvc-a": {"iqn.node-1"},
+		"pvc-c": {anyNode},
+	}
+
+	assert.Equal([]staleVolumeMap{
+		{volumeID: "pvc-a", initiator: "iqn.node-2"},
+		{volumeID: "pvc-b", initiator: "iqn.node-1"},
+	}, findStaleVolumeMaps(volumes, volumeMaps, attachments))
+}
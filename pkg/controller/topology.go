@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package controller
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// getAccessibleTopology returns the topology from which a volume hosted on the given array is accessible. Volumes
+// of storage classes which do not name their array are considered accessible from everywhere.
+func getAccessibleTopology(arrayName string, requirements *csi.TopologyRequirement) ([]*csi.Topology, error) {
+	if arrayName == "" {
+		return nil, nil
+	}
+
+	key := common.ArrayTopologyKey(arrayName)
+	if requisite := requirements.GetRequisite(); len(requisite) > 0 {
+		reachable := false
+		for _, topology := range requisite {
+			if topology.GetSegments()[key] == common.ArrayReachableTopologyValue {
+				reachable = true
+				break
+			}
+		}
+		if !reachable {
+			return nil, status.Errorf(codes.ResourceExhausted, "array %s is not reachable from any of the requisite topologies", arrayName)
+		}
+	}
+
+	return []*csi.Topology{
+		{Segments: map[string]string{key: common.ArrayReachableTopologyValue}},
+	}, nil
+}
@@ -0,0 +1,46 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_getAccessibleTopology(t *testing.T) {
+	assert := assert.New(t)
+
+	reachable := &csi.Topology{Segments: map[string]string{common.ArrayTopologyKey("msa1"): "true"}}
+	unreachable := &csi.Topology{Segments: map[string]string{common.TopologyKey("site"): "paris"}}
+
+	tests := []struct {
+		name         string
+		arrayName    string
+		requirements *csi.TopologyRequirement
+		accessible   bool
+		fails        bool
+	}{
+		{name: "no array", requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{unreachable}}},
+		{name: "no requirements", arrayName: "msa1", accessible: true},
+		{name: "reachable", arrayName: "msa1", requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{unreachable, reachable}}, accessible: true},
+		{name: "unreachable", arrayName: "msa1", requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{unreachable}}, fails: true},
+		{name: "other array", arrayName: "msa2", requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{reachable}}, fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			topology, err := getAccessibleTopology(test.arrayName, test.requirements)
+			if test.fails {
+				assert.Error(err)
+				return
+			}
+			assert.Nil(err)
+			if test.accessible {
+				assert.Equal([]*csi.Topology{{Segments: map[string]string{common.ArrayTopologyKey(test.arrayName): "true"}}}, topology)
+			} else {
+				assert.Nil(topology)
+			}
+		})
+	}
+}
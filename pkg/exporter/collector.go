@@ -28,8 +28,12 @@ import (
 )
 
 type Collector struct {
-	csiRPCCall         *prometheus.CounterVec
-	csiRPCCallDuration *prometheus.CounterVec
+	csiRPCCall            *prometheus.CounterVec
+	csiRPCCallDuration    *prometheus.CounterVec
+	orphanedVolumes       *prometheus.GaugeVec
+	orphanedVolumeDeleted *prometheus.CounterVec
+	staleVolumeMaps       *prometheus.GaugeVec
+	staleVolumeMapRemoved *prometheus.CounterVec
 }
 
 const (
@@ -38,6 +42,18 @@ const (
 
 	csiRPCCallDurationMetric = "san_iscsi_csi_rpc_call_duration"
 	csiRPCCallDurationHelp   = "The total duration of CSI RPC calls"
+
+	orphanedVolumesMetric = "san_iscsi_csi_orphaned_volumes"
+	orphanedVolumesHelp   = "How many array volumes created by the driver are not referenced by any persistent volume"
+
+	orphanedVolumeDeletedMetric = "san_iscsi_csi_orphaned_volume_deleted"
+	orphanedVolumeDeletedHelp   = "How many orphaned array volumes have been deleted"
+
+	staleVolumeMapsMetric = "san_iscsi_csi_stale_volume_maps"
+	staleVolumeMapsHelp   = "How many array volume mappings are not justified by any volume attachment"
+
+	staleVolumeMapRemovedMetric = "san_iscsi_csi_stale_volume_map_removed"
+	staleVolumeMapRemovedHelp   = "How many stale array volume mappings have been removed"
 )
 
 func NewCollector() *Collector {
@@ -56,17 +72,53 @@ func NewCollector() *Collector {
 			},
 			[]string{"endpoint"},
 		),
+		orphanedVolumes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: orphanedVolumesMetric,
+				Help: orphanedVolumesHelp,
+			},
+			[]string{"array"},
+		),
+		orphanedVolumeDeleted: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: orphanedVolumeDeletedMetric,
+				Help: orphanedVolumeDeletedHelp,
+			},
+			[]string{"array", "success"},
+		),
+		staleVolumeMaps: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: staleVolumeMapsMetric,
+				Help: staleVolumeMapsHelp,
+			},
+			[]string{"array"},
+		),
+		staleVolumeMapRemoved: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: staleVolumeMapRemovedMetric,
+				Help: staleVolumeMapRemovedHelp,
+			},
+			[]string{"array", "success"},
+		),
 	}
 }
 
 func (collector *Collector) Describe(ch chan<- *prometheus.Desc) {
 	collector.csiRPCCall.Describe(ch)
 	collector.csiRPCCallDuration.Describe(ch)
+	collector.orphanedVolumes.Describe(ch)
+	collector.orphanedVolumeDeleted.Describe(ch)
+	collector.staleVolumeMaps.Describe(ch)
+	collector.staleVolumeMapRemoved.Describe(ch)
 }
 
 func (collector *Collector) Collect(ch chan<- prometheus.Metric) {
 	collector.csiRPCCall.Collect(ch)
 	collector.csiRPCCallDuration.Collect(ch)
+	collector.orphanedVolumes.Collect(ch)
+	collector.orphanedVolumeDeleted.Collect(ch)
+	collector.staleVolumeMaps.Collect(ch)
+	collector.staleVolumeMapRemoved.Collect(ch)
 }
 
 func (collector *Collector) IncCSIRPCCall(method string, success bool) {
@@ -76,3 +128,19 @@ func (collector *Collector) IncCSIRPCCall(method string, success bool) {
 func (collector *Collector) AddCSIRPCCallDuration(method string, duration time.Duration) {
 	collector.csiRPCCallDuration.WithLabelValues(method).Add(float64(duration.Nanoseconds()) / 1000 / 1000 / 1000)
 }
+
+func (collector *Collector) SetOrphanedVolumes(array string, count int) {
+	collector.orphanedVolumes.WithLabelValues(array).Set(float64(count))
+}
+
+func (collector *Collector) IncOrphanedVolumeDeleted(array string, success bool) {
+	collector.orphanedVolumeDeleted.WithLabelValues(array, fmt.Sprintf("%t", success)).Inc()
+}
+
+func (collector *Collector) SetStaleVolumeMaps(array string, count int) {
+	collector.staleVolumeMaps.WithLabelValues(array).Set(float64(count))
+}
+
+func (collector *Collector) IncStaleVolumeMapRemoved(array string, success bool) {
+	collector.staleVolumeMapRemoved.WithLabelValues(array, fmt.Sprintf("%t", success)).Inc()
+}
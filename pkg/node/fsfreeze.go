@@ -0,0 +1,211 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package node
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"k8s.io/klog"
+)
+
+var errVolumeNotFrozen = errors.New("volume is not frozen")
+
+// fsThawRetryInterval is the delay before thawing again a filesystem which could not be thawed
+const fsThawRetryInterval = 5 * time.Second
+
+// frozenVolume is a volume whose filesystem is frozen until it gets thawed, or its timer expires
+type frozenVolume struct {
+	path  string
+	timer *time.Timer
+}
+
+// fsFreezer tracks the filesystems frozen on behalf of the controller
+type fsFreezer struct {
+	mutex   sync.Mutex
+	volumes map[string]*frozenVolume
+}
+
+func newFsFreezer() *fsFreezer {
+	return &fsFreezer{volumes: map[string]*frozenVolume{}}
+}
+
+// ServeFsFreeze serves over TLS the endpoint used by the controller to freeze filesystems while snapshotting them,
+// authenticating requests with the given token. It never returns.
+func (node *Node) ServeFsFreeze(address string, token string, certificate tls.Certificate) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(common.FsFreezePath, node.authenticateFsFreeze(token, node.handleFsFreeze))
+	mux.HandleFunc(common.FsThawPath, node.authenticateFsFreeze(token, node.handleFsThaw))
+
+	server := &http.Server{
+		Addr:    address,
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+
+	klog.Infof("serving filesystem freeze endpoint on %s", address)
+	klog.Fatal(server.ListenAndServeTLS("", ""))
+}
+
+func (node *Node) authenticateFsFreeze(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if !common.IsAuthorized(r, token) {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		if r.FormValue("volume") == "" {
+			http.Error(w, "missing volume parameter", http.StatusBadRequest)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (node *Node) handleFsFreeze(w http.ResponseWriter, r *http.Request) {
+	volumeID := r.FormValue("volume")
+	timeout, err := time.ParseDuration(r.FormValue("timeout"))
+	if err != nil || timeout <= 0 || timeout > common.MaxFsFreezeTimeout {
+		http.Error(w, fmt.Sprintf("timeout must be a duration up to %s", common.MaxFsFreezeTimeout), http.StatusBadRequest)
+		return
+	}
+
+	info, err := node.loadVolumeInfo(volumeID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if info.Block {
+		klog.Infof("volume %s is a raw block device, there is no filesystem to freeze", volumeID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if info.TargetPath == "" {
+		http.Error(w, fmt.Sprintf("volume %s is not published on this node, or was published by a previous version", volumeID), http.StatusNotFound)
+		return
+	}
+
+	if err = node.freezer.freeze(volumeID, info.TargetPath, timeout); err != nil {
+		klog.Errorf("could not freeze volume %s: %v", volumeID, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	fmt.Fprintf(w, "volume %s frozen for at most %s\n", volumeID, timeout)
+}
+
+func (node *Node) handleFsThaw(w http.ResponseWriter, r *http.Request) {
+	volumeID := r.FormValue("volume")
+	if err := node.freezer.thaw(volumeID); err == errVolumeNotFrozen {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		klog.Errorf("could not thaw volume %s: %v", volumeID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "volume %s thawed\n", volumeID)
+}
+
+// freeze freezes the filesystem mounted at the given path, which gets thawed automatically after the timeout
+func (freezer *fsFreezer) freeze(volumeID string, path string, timeout time.Duration) error {
+	freezer.mutex.Lock()
+	defer freezer.mutex.Unlock()
+
+	if _, ok := freezer.volumes[volumeID]; ok {
+		return fmt.Errorf("volume %s is already frozen", volumeID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	klog.Infof("freezing filesystem of volume %s mounted at %s for at most %s", volumeID, path, timeout)
+	if out, err := exec.CommandContext(ctx, "fsfreeze", "--freeze", path).CombinedOutput(); err != nil {
+		// a freeze interrupted by the timeout may have been effective, while any other failure leaves the filesystem
+		// as it was, possibly frozen by someone else
+		if ctx.Err() == context.DeadlineExceeded {
+			execCommand("fsfreeze", "--unfreeze", path).Run()
+		}
+		return fmt.Errorf("could not freeze filesystem: %s", out)
+	}
+
+	volume := &frozenVolume{path: path}
+	volume.timer = time.AfterFunc(timeout, func() {
+		freezer.mutex.Lock()
+		defer freezer.mutex.Unlock()
+
+		if freezer.volumes[volumeID] != volume {
+			return
+		}
+		if err := freezer.unfreeze(volumeID, volume); err != nil {
+			klog.Errorf("could not thaw volume %s after its %s timeout expired, retrying in %s: %v", volumeID, timeout, fsThawRetryInterval, err)
+		} else {
+			klog.Warningf("volume %s was thawed after its %s timeout expired", volumeID, timeout)
+		}
+	})
+	freezer.volumes[volumeID] = volume
+	return nil
+}
+
+// thaw thaws the filesystem of the given volume, returning errVolumeNotFrozen if it is not frozen
+func (freezer *fsFreezer) thaw(volumeID string) error {
+	freezer.mutex.Lock()
+	defer freezer.mutex.Unlock()
+
+	volume, ok := freezer.volumes[volumeID]
+	if !ok {
+		return errVolumeNotFrozen
+	}
+	return freezer.unfreeze(volumeID, volume)
+}
+
+// unfreeze thaws the filesystem of the frozen volume, which is only forgotten once thawed: on failure, its timer is
+// re-armed to retry, so that the filesystem does not stay frozen forever. The freezer mutex must be held.
+func (freezer *fsFreezer) unfreeze(volumeID string, volume *frozenVolume) error {
+	klog.Infof("thawing filesystem of volume %s mounted at %s", volumeID, volume.path)
+	if out, err := execCommand("fsfreeze", "--unfreeze", volume.path).CombinedOutput(); err != nil {
+		// unfreezing a filesystem which is not frozen anymore fails with EINVAL
+		if !strings.Contains(string(out), "Invalid argument") {
+			volume.timer.Reset(fsThawRetryInterval)
+			return fmt.Errorf("could not thaw filesystem: %s", out)
+		}
+		klog.Warningf("filesystem of volume %s was already thawed", volumeID)
+	}
+
+	volume.timer.Stop()
+	delete(freezer.volumes, volumeID)
+	return nil
+}
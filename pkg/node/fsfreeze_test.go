@@ -0,0 +1,54 @@
+package node
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_authenticateFsFreeze(t *testing.T) {
+	assert := assert.New(t)
+
+	node := &Node{freezer: newFsFreezer()}
+	handler := node.authenticateFsFreeze("secret", func(w http.ResponseWriter, r *http.Request) {})
+
+	request := func(method string, target string, token string) int {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		handler(recorder, req)
+		return recorder.Code
+	}
+
+	assert.Equal(http.StatusOK, request(http.MethodPost, "/fsfreeze?volume=pvc-a", "secret"))
+	assert.Equal(http.StatusUnauthorized, request(http.MethodPost, "/fsfreeze?volume=pvc-a", "invalid"))
+	assert.Equal(http.StatusMethodNotAllowed, request(http.MethodGet, "/fsfreeze?volume=pvc-a", "secret"))
+	assert.Equal(http.StatusBadRequest, request(http.MethodPost, "/fsfreeze", "secret"))
+}
+
+func Test_fsFreezer_thaw(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func() { execCommand = exec.Command }()
+
+	assert.Equal(errVolumeNotFrozen, newFsFreezer().thaw("pvc-a"), "volumes which are not frozen should be reported")
+
+	freezer := newFsFreezer()
+	volume := &frozenVolume{path: "/mnt/pvc-a", timer: time.AfterFunc(time.Hour, func() {})}
+	freezer.volumes["pvc-a"] = volume
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		return exec.Command("sh", "-c", "echo 'fsfreeze: /mnt/pvc-a: unfreeze failed: Device or resource busy'; exit 1")
+	}
+	assert.Error(freezer.thaw("pvc-a"))
+	assert.Equal(volume, freezer.volumes["pvc-a"], "volumes which could not be thawed should stay frozen until thawed")
+
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		return exec.Command("true")
+	}
+	assert.Nil(freezer.thaw("pvc-a"))
+	assert.Empty(freezer.volumes)
+}
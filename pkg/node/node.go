@@ -27,6 +27,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -47,8 +48,12 @@ import (
 type Node struct {
 	*common.Driver
 
+	// Topology is reported to the container orchestrator so that volumes are only used where their array is reachable
+	Topology *Topology
+
 	semaphore *semaphore.Weighted
 	runPath   string
+	freezer   *fsFreezer
 }
 
 // New is a convenience function for creating a node driver
@@ -61,6 +66,7 @@ func New() *Node {
 		Driver:    common.NewDriver(),
 		semaphore: semaphore.NewWeighted(1),
 		runPath:   fmt.Sprintf("/var/run/%s", common.PluginName),
+		freezer:   newFsFreezer(),
 	}
 
 	if err := os.MkdirAll(node.runPath, 0755); err != nil {
@@ -98,8 +104,9 @@ func (node *Node) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest)
 	}
 
 	return &csi.NodeGetInfoResponse{
-		NodeId:            initiatorName,
-		MaxVolumesPerNode: 255,
+		NodeId:             initiatorName,
+		MaxVolumesPerNode:  255,
+		AccessibleTopology: node.Topology.getAccessibleTopology(),
 	}, nil
 }
 
@@ -138,7 +145,7 @@ func (node *Node) NodePublishVolume(ctx context.Context, req *csi.NodePublishVol
 
 	klog.Infof("publishing volume %s", req.GetVolumeId())
 
-	portals := strings.Split(req.GetVolumeContext()[common.PortalsConfigKey], ",")
+	portals := strings.Split(getPublishParameter(req, common.PortalsConfigKey), ",")
 	klog.Infof("ISCSI portals: %s", portals)
 
 	lun, _ := strconv.ParseInt(req.GetPublishContext()["lun"], 10, 32)
@@ -146,53 +153,63 @@ func (node *Node) NodePublishVolume(ctx context.Context, req *csi.NodePublishVol
 
 	klog.Info("initiating ISCSI connection...")
 	connector := &iscsi.Connector{
-		TargetIqn:     req.GetVolumeContext()[common.TargetIQNConfigKey],
+		TargetIqn:     getPublishParameter(req, common.TargetIQNConfigKey),
 		TargetPortals: portals,
 		Lun:           int32(lun),
 		DoDiscovery:   true,
 	}
+	if err := configureChap(connector, req.GetSecrets()); err != nil {
+		return nil, err
+	}
 	path, err := connector.Connect()
 	if err != nil {
 		return nil, status.Error(codes.Unavailable, err.Error())
 	}
 	klog.Infof("attached device at %s", path)
 
+	// the session and device must not be left behind if the volume cannot be published
+	published := false
+	reservationKey := ""
+	defer func() {
+		if !published {
+			abortPublish(req.GetVolumeId(), connector, reservationKey)
+		}
+	}()
+
 	if connector.IsMultipathEnabled() {
 		klog.Info("device is using multipath")
 	} else {
 		klog.Info("device is NOT using multipath")
 	}
 
-	fsType := req.GetVolumeContext()[common.FsTypeConfigKey]
-	err = ensureFsType(fsType, path)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	if err = checkFs(path); err != nil {
-		return nil, status.Errorf(codes.DataLoss, "filesystem seems to be corrupted: %v", err)
-	}
+	readOnly := req.GetReadonly() || req.GetVolumeCapability().GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
 
-	out, err := exec.Command("findmnt", "--output", "TARGET", "--noheadings", path).Output()
-	mountpoints := strings.Split(strings.Trim(string(out), "\n"), "\n")
-	if err != nil || len(mountpoints) == 0 {
-		klog.Infof("mounting volume at %s", req.GetTargetPath())
-		os.Mkdir(req.GetTargetPath(), 00755)
-		out, err = exec.Command("mount", "-t", fsType, path, req.GetTargetPath()).CombinedOutput()
+	// read-only volumes can be shared, and reservations do not prevent other hosts from reading anyway
+	if req.GetVolumeContext()[common.ReservationConfigKey] == "true" && !readOnly {
+		initiatorName, err := readInitiatorName()
 		if err != nil {
-			return nil, status.Error(codes.Internal, string(out))
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
 		}
-	} else if len(mountpoints) == 1 {
-		if mountpoints[0] == req.GetTargetPath() {
-			klog.Infof("volume %s already mounted", req.GetTargetPath())
-		} else {
-			errStr := fmt.Sprintf("device has already been mounted somewhere else (%s instead of %s), please unmount first", mountpoints[0], req.GetTargetPath())
-			return nil, status.Error(codes.Internal, errStr)
+
+		reservationKey = getReservationKey(initiatorName)
+		if err = reserveVolume(req.GetVolumeId(), connector, reservationKey); err != nil {
+			return nil, err
 		}
-	} else if len(mountpoints) > 1 {
-		return nil, errors.New("device has already been mounted in several locations, please unmount first")
 	}
 
+	if req.GetVolumeCapability().GetBlock() != nil {
+		err = publishBlockVolume(path, req.GetTargetPath(), readOnly)
+	} else {
+		err = publishFilesystemVolume(path, req.GetTargetPath(), req.GetVolumeContext()[common.FsTypeConfigKey], readOnly)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// credentials are not needed to disconnect, thus they are not persisted
+	connector.DiscoverySecrets = iscsi.Secrets{}
+	connector.SessionSecrets = iscsi.Secrets{}
+
 	iscsiInfoPath := node.getIscsiInfoPath(req.GetVolumeId())
 	klog.Infof("saving ISCSI connection info in %s", iscsiInfoPath)
 	err = connector.Persist(iscsiInfoPath)
@@ -200,6 +217,16 @@ func (node *Node) NodePublishVolume(ctx context.Context, req *csi.NodePublishVol
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	err = node.saveVolumeInfo(req.GetVolumeId(), &volumeInfo{
+		Block:          req.GetVolumeCapability().GetBlock() != nil,
+		ReservationKey: reservationKey,
+		TargetPath:     req.GetTargetPath(),
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	published = true
 	klog.Infof("successfully mounted volume at %s", req.GetTargetPath())
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -215,10 +242,20 @@ func (node *Node) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublis
 
 	klog.Infof("unpublishing volume %s", req.GetVolumeId())
 
-	_, err := os.Stat(req.GetTargetPath())
+	info, err := node.loadVolumeInfo(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// a frozen filesystem cannot be unmounted, do not wait for the freeze timeout
+	if err = node.freezer.thaw(req.GetVolumeId()); err != nil && err != errVolumeNotFrozen {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	_, err = os.Stat(req.GetTargetPath())
 	if err == nil {
 		klog.Infof("unmounting volume at %s", req.GetTargetPath())
-		out, err := exec.Command("mountpoint", req.GetTargetPath()).CombinedOutput()
+		out, err := exec.Command("findmnt", "--mountpoint", req.GetTargetPath()).CombinedOutput()
 		if err == nil {
 			out, err := exec.Command("umount", req.GetTargetPath()).CombinedOutput()
 			if err != nil {
@@ -242,12 +279,13 @@ func (node *Node) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublis
 	if err != nil {
 		if os.IsNotExist(err) {
 			klog.Warning(errors.Wrap(err, "assuming that ISCSI connection is already closed"))
+			node.deleteVolumeInfo(req.GetVolumeId())
 			return &csi.NodeUnpublishVolumeResponse{}, nil
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	if isVolumeInUse(connector.MountTargetDevice.GetPath()) {
+	if isVolumeInUse(connector.MountTargetDevice.GetPath()) || (info.Block && isBlockVolumeInUse(connector.MountTargetDevice.GetPath())) {
 		klog.Info("volume is still in use on the node, thus it will not be detached")
 		return &csi.NodeUnpublishVolumeResponse{}, nil
 	}
@@ -258,8 +296,16 @@ func (node *Node) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublis
 		return &csi.NodeUnpublishVolumeResponse{}, nil
 	}
 
-	if err = checkFs(connector.MountTargetDevice.GetPath()); err != nil {
-		return nil, status.Errorf(codes.DataLoss, "Filesystem seems to be corrupted: %v", err)
+	if !info.Block {
+		if err = checkFs(connector.MountTargetDevice.GetPath()); err != nil {
+			return nil, status.Errorf(codes.DataLoss, "Filesystem seems to be corrupted: %v", err)
+		}
+	}
+
+	if info.ReservationKey != "" {
+		if err = releaseVolume(req.GetVolumeId(), connector, info.ReservationKey); err != nil {
+			klog.Warningf("could not release reservation of volume %s, it has to be released before publishing it to another node: %v", req.GetVolumeId(), err)
+		}
 	}
 
 	klog.Info("detaching ISCSI device")
@@ -270,11 +316,36 @@ func (node *Node) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublis
 
 	klog.Infof("deleting ISCSI connection info file %s", iscsiInfoPath)
 	os.Remove(iscsiInfoPath)
+	node.deleteVolumeInfo(req.GetVolumeId())
 
 	klog.Info("successfully detached ISCSI device")
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+// abortPublish detaches the device of a volume which could not be published, releasing its reservation if any,
+// unless the device is used by another publication of the volume on the node
+func abortPublish(volumeID string, connector *iscsi.Connector, reservationKey string) {
+	if connector.MountTargetDevice == nil {
+		return
+	}
+	device := connector.MountTargetDevice.GetPath()
+	if isVolumeInUse(device) || isBlockVolumeInUse(device) {
+		klog.Info("volume is still in use on the node, thus it will not be detached")
+		return
+	}
+
+	if reservationKey != "" {
+		if err := releaseVolume(volumeID, connector, reservationKey); err != nil {
+			klog.Warningf("could not release reservation of volume %s: %v", volumeID, err)
+		}
+	}
+
+	klog.Info("detaching ISCSI device of the volume which could not be published")
+	if err := connector.DisconnectVolume(); err != nil {
+		klog.Warningf("could not detach ISCSI device of volume %s: %v", volumeID, err)
+	}
+}
+
 // NodeExpandVolume finalizes volume expansion on the node
 func (node *Node) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
 	iscsiInfoPath := node.getIscsiInfoPath(req.GetVolumeId())
@@ -296,6 +367,15 @@ func (node *Node) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolum
 		klog.V(2).Info("device is NOT using multipath")
 	}
 
+	info, err := node.loadVolumeInfo(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if info.Block || req.GetVolumeCapability().GetBlock() != nil {
+		klog.Info("volume is a raw block device, skipping filesystem expansion")
+		return &csi.NodeExpandVolumeResponse{}, nil
+	}
+
 	klog.Infof("expanding filesystem on device %s", connector.MountTargetDevice.GetPath())
 	output, err := exec.Command("resize2fs", connector.MountTargetDevice.GetPath()).CombinedOutput()
 	if err != nil {
@@ -338,8 +418,8 @@ func (node *Node) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeR
 		"findmnt",
 		"mount",
 		"umount",
-		"mountpoint",
 		"resize2fs",
+		"dumpe2fs",
 		"e2fsck",
 		"blkid",
 		"mkfs.ext4",
@@ -354,10 +434,134 @@ func (node *Node) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeR
 	return &csi.ProbeResponse{}, nil
 }
 
+// getPublishParameter returns the parameter discovered by the controller when the volume was published,
+// or the one of the storage class for volumes published by previous versions of the controller
+func getPublishParameter(req *csi.NodePublishVolumeRequest, key string) string {
+	if value := req.GetPublishContext()[key]; value != "" {
+		return value
+	}
+	return req.GetVolumeContext()[key]
+}
+
 func (node *Node) getIscsiInfoPath(volumeID string) string {
 	return fmt.Sprintf("%s/iscsi-%s.json", node.runPath, volumeID)
 }
 
+// configureChap sets up CHAP authentication for both discovery and session login if secrets contain
+// a CHAP secret, using the initiator name as username as the array does. Mutual CHAP is set up if they
+// also contain a target secret.
+func configureChap(connector *iscsi.Connector, secrets map[string]string) error {
+	secret := secrets[common.ChapSecretSecretKey]
+	if secret == "" {
+		return nil
+	}
+
+	initiatorName, err := readInitiatorName()
+	if err != nil {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	chapSecrets := iscsi.Secrets{
+		SecretsType: "chap",
+		UserName:    initiatorName,
+		Password:    secret,
+	}
+	if mutualSecret := secrets[common.MutualChapSecretSecretKey]; mutualSecret != "" {
+		klog.Info("using mutual CHAP authentication")
+		chapSecrets.UserNameIn = connector.TargetIqn
+		chapSecrets.PasswordIn = mutualSecret
+	} else {
+		klog.Info("using CHAP authentication")
+	}
+
+	connector.AuthType = "chap"
+	connector.DiscoverySecrets = chapSecrets
+	connector.SessionSecrets = chapSecrets
+	connector.DoCHAPDiscovery = true
+	return nil
+}
+
+func publishFilesystemVolume(path string, targetPath string, fsType string, readOnly bool) error {
+	if readOnly {
+		currentFsType, err := findDeviceFormat(path)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if currentFsType != fsType {
+			return status.Errorf(codes.FailedPrecondition, "cannot publish read-only volume with %q filesystem as %s", currentFsType, fsType)
+		}
+	} else if err := ensureFsType(fsType, path); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if err := checkFs(path); err != nil {
+		return status.Errorf(codes.DataLoss, "filesystem seems to be corrupted: %v", err)
+	}
+
+	mountOptions := "rw"
+	if readOnly {
+		mountOptions = "ro"
+	}
+
+	out, err := exec.Command("findmnt", "--output", "TARGET", "--noheadings", path).Output()
+	mountpoints := strings.Split(strings.Trim(string(out), "\n"), "\n")
+	if err != nil || len(mountpoints) == 0 {
+		klog.Infof("mounting volume at %s (%s)", targetPath, mountOptions)
+		os.Mkdir(targetPath, 00755)
+		out, err = exec.Command("mount", "-t", fsType, "-o", mountOptions, path, targetPath).CombinedOutput()
+		if err != nil {
+			return status.Error(codes.Internal, string(out))
+		}
+	} else if len(mountpoints) == 1 {
+		if mountpoints[0] == targetPath {
+			klog.Infof("volume %s already mounted", targetPath)
+		} else {
+			errStr := fmt.Sprintf("device has already been mounted somewhere else (%s instead of %s), please unmount first", mountpoints[0], targetPath)
+			return status.Error(codes.Internal, errStr)
+		}
+	} else if len(mountpoints) > 1 {
+		return errors.New("device has already been mounted in several locations, please unmount first")
+	}
+
+	// volumes cloned or restored to a larger size than their source carry a filesystem smaller than the device
+	if !readOnly {
+		if err := growFilesystem(path, fsType); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func publishBlockVolume(path string, targetPath string, readOnly bool) error {
+	out, err := exec.Command("findmnt", "--noheadings", "--mountpoint", targetPath).Output()
+	if err == nil && len(out) > 0 {
+		klog.Infof("block device already bind mounted at %s", targetPath)
+		return nil
+	}
+
+	klog.Infof("bind mounting block device %s at %s (read-only: %t)", path, targetPath, readOnly)
+	if err = os.MkdirAll(filepath.Dir(targetPath), 00750); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	file, err := os.OpenFile(targetPath, os.O_CREATE, 00640)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	file.Close()
+
+	mountArgs := []string{"--bind", path, targetPath}
+	if readOnly {
+		mountArgs = append([]string{"-o", "ro"}, mountArgs...)
+	}
+	out, err = exec.Command("mount", mountArgs...).CombinedOutput()
+	if err != nil {
+		return status.Error(codes.Internal, string(out))
+	}
+
+	return nil
+}
+
 func checkHostBinary(name string) error {
 	klog.V(5).Infof("checking that binary %q exists in host PATH", name)
 
@@ -487,3 +691,26 @@ func isVolumeInUse(devicePath string) bool {
 	}
 	return true
 }
+
+// isBlockVolumeInUse looks for bind mounts of the device file, which findmnt lists with a
+// source relative to /dev (e.g. "udev[/dm-0]") instead of the device path itself
+func isBlockVolumeInUse(devicePath string) bool {
+	out, err := exec.Command("findmnt", "--list", "--noheadings", "--output", "SOURCE").CombinedOutput()
+	if err != nil {
+		return true
+	}
+
+	devicePaths := []string{devicePath}
+	if resolvedPath, err := filepath.EvalSymlinks(devicePath); err == nil && resolvedPath != devicePath {
+		devicePaths = append(devicePaths, resolvedPath)
+	}
+
+	for _, source := range strings.Split(string(out), "\n") {
+		for _, path := range devicePaths {
+			if strings.HasSuffix(source, fmt.Sprintf("[%s]", strings.TrimPrefix(path, "/dev"))) {
+				return true
+			}
+		}
+	}
+	return false
+}
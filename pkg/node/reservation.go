@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+
+	"github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// reservationType is "Write Exclusive - Registrants Only", so that every path of the node can write once registered
+const reservationType = "5"
+
+var reservationKeyRegexp = regexp.MustCompile(`Key\s*=\s*(0x[0-9a-fA-F]+)`)
+
+// getReservationKey derives the SCSI persistent reservation key of the node from its initiator name
+func getReservationKey(initiatorName string) string {
+	hash := sha256.Sum256([]byte(initiatorName))
+	return fmt.Sprintf("0x%016x", binary.BigEndian.Uint64(hash[:8]))
+}
+
+// parseReservationKey returns the key holding the reservation from the output of sg_persist --read-reservation,
+// or an empty string if there is no reservation
+func parseReservationKey(output string) (string, error) {
+	match := reservationKeyRegexp.FindStringSubmatch(output)
+	if match == nil {
+		return "", nil
+	}
+
+	key, err := strconv.ParseUint(match[1], 0, 64)
+	if err != nil {
+		return "", fmt.Errorf("could not parse reservation key %q: %v", match[1], err)
+	}
+	return fmt.Sprintf("0x%016x", key), nil
+}
+
+func runSgPersist(args ...string) (string, error) {
+	klog.V(2).Infof("running sg_persist %v", args)
+	output, err := exec.Command("sg_persist", args...).CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("sg_persist %v failed: %v: %s", args, err, output)
+	}
+	return string(output), nil
+}
+
+// reserveVolume registers the key on every path of the device then reserves it, unless another host holds a reservation
+func reserveVolume(volumeID string, connector *iscsi.Connector, key string) error {
+	if err := checkHostBinary("sg_persist"); err != nil {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	devicePath := connector.MountTargetDevice.GetPath()
+	output, err := runSgPersist("--in", "--read-reservation", "--no-inquiry", devicePath)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	holder, err := parseReservationKey(output)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if holder != "" && holder != key {
+		return status.Errorf(codes.FailedPrecondition, "volume %s is reserved by another host (key %s), it may still be in use there", volumeID, holder)
+	}
+
+	for _, device := range connector.Devices {
+		if _, err := runSgPersist("--out", "--register-ignore", "--param-sark="+key, device.GetPath()); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if holder == "" {
+		klog.Infof("reserving volume %s with key %s", volumeID, key)
+		if _, err := runSgPersist("--out", "--reserve", "--param-rk="+key, "--prout-type="+reservationType, devicePath); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	} else {
+		klog.Infof("volume %s is already reserved by this node", volumeID)
+	}
+
+	return nil
+}
+
+// releaseVolume releases the reservation of the device and unregisters the key from every path
+func releaseVolume(volumeID string, connector *iscsi.Connector, key string) error {
+	klog.Infof("releasing reservation of volume %s with key %s", volumeID, key)
+	if _, err := runSgPersist("--out", "--release", "--param-rk="+key, "--prout-type="+reservationType, connector.MountTargetDevice.GetPath()); err != nil {
+		return err
+	}
+
+	for _, device := range connector.Devices {
+		if _, err := runSgPersist("--out", "--register", "--param-rk="+key, "--param-sark=0", device.GetPath()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_getReservationKey(t *testing.T) {
+	assert := assert.New(t)
+
+	key := getReservationKey("iqn.1993-08.org.debian:01:node-1")
+	assert.Len(key, 18)
+	assert.Equal(key, getReservationKey("iqn.1993-08.org.debian:01:node-1"))
+	assert.NotEqual(key, getReservationKey("iqn.1993-08.org.debian:01:node-2"))
+}
+
+func Test_parseReservationKey(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := parseReservationKey("  PR generation=0x3, Reservation follows:\n    Key=0x1a2b\n    scope: LU_SCOPE,  type: Write Exclusive, registrants only\n")
+	assert.Nil(err)
+	assert.Equal("0x0000000000001a2b", key)
+
+	key, err = parseReservationKey("  PR generation=0x0, there is NO reservation held\n")
+	assert.Nil(err)
+	assert.Equal("", key)
+}
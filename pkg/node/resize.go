@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package node
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// extFsTypes are the filesystems which can be grown by resize2fs
+var extFsTypes = map[string]bool{"ext2": true, "ext3": true, "ext4": true}
+
+// execCommand creates the commands inspecting, growing and thawing filesystems, replaced in tests
+var execCommand = exec.Command
+
+var (
+	blockCountRegexp = regexp.MustCompile(`(?m)^Block count:\s*(\d+)$`)
+	blockSizeRegexp  = regexp.MustCompile(`(?m)^Block size:\s*(\d+)$`)
+)
+
+// growFilesystem grows the ext filesystem of the device to the device size when it is at least one block smaller,
+// as for volumes cloned or restored to a larger size than their source. Other filesystems are left as is.
+func growFilesystem(device string, fsType string) error {
+	if !extFsTypes[fsType] {
+		klog.V(2).Infof("not checking the size of the %s filesystem on device %s", fsType, device)
+		return nil
+	}
+
+	resize, err := needsResize(device)
+	if err != nil {
+		return err
+	}
+	if !resize {
+		return nil
+	}
+
+	klog.Infof("growing filesystem on device %s to the device size", device)
+	if out, err := execCommand("resize2fs", device).CombinedOutput(); err != nil {
+		return fmt.Errorf("could not resize filesystem: %s", out)
+	}
+	return nil
+}
+
+// needsResize reports whether the ext filesystem of the device is at least one block smaller than the device,
+// as for volumes cloned or restored to a larger size than their source
+func needsResize(device string) (bool, error) {
+	out, err := execCommand("blockdev", "--getsize64", device).CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("could not get size of device %s: %s", device, out)
+	}
+	deviceSize, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("could not parse size of device %s: %v", device, err)
+	}
+
+	out, err = execCommand("dumpe2fs", "-h", device).Output()
+	if err != nil {
+		return false, fmt.Errorf("could not read filesystem superblock of device %s: %v", device, err)
+	}
+	blockCount, blockSize, err := parseExtFsGeometry(string(out))
+	if err != nil {
+		return false, err
+	}
+
+	klog.V(2).Infof("device %s has %d bytes, its filesystem has %d blocks of %d bytes", device, deviceSize, blockCount, blockSize)
+	return deviceSize-blockCount*blockSize >= blockSize, nil
+}
+
+// parseExtFsGeometry returns the block count and block size of an ext filesystem from the output of dumpe2fs -h
+func parseExtFsGeometry(output string) (int64, int64, error) {
+	countMatch := blockCountRegexp.FindStringSubmatch(output)
+	sizeMatch := blockSizeRegexp.FindStringSubmatch(output)
+	if countMatch == nil || sizeMatch == nil {
+		return 0, 0, fmt.Errorf("could not find the block count and size of the filesystem in %q", output)
+	}
+
+	blockCount, err := strconv.ParseInt(countMatch[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	blockSize, err := strconv.ParseInt(sizeMatch[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return blockCount, blockSize, nil
+}
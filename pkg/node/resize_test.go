@@ -0,0 +1,43 @@
+package node
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseExtFsGeometry(t *testing.T) {
+	assert := assert.New(t)
+
+	blockCount, blockSize, err := parseExtFsGeometry("Filesystem volume name:   <none>\nInode count:              65536\nBlock count:              262144\nReserved block count:     13107\nBlock size:               4096\nFragment size:            4096\n")
+	assert.Nil(err)
+	assert.Equal(int64(262144), blockCount)
+	assert.Equal(int64(4096), blockSize)
+
+	_, _, err = parseExtFsGeometry("dumpe2fs: Bad magic number in super-block while trying to open /dev/sdb\n")
+	assert.Error(err)
+}
+
+func Test_growFilesystem(t *testing.T) {
+	assert := assert.New(t)
+	defer func() { execCommand = exec.Command }()
+
+	commands := []string{}
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		commands = append(commands, name)
+		switch name {
+		case "blockdev":
+			return exec.Command("echo", "2147483648")
+		case "dumpe2fs":
+			return exec.Command("echo", "Block count:              262144\nBlock size:               4096")
+		}
+		return exec.Command("true")
+	}
+
+	assert.Nil(growFilesystem("/dev/dm-0", "xfs"))
+	assert.Empty(commands, "only ext filesystems should be checked and grown")
+
+	assert.Nil(growFilesystem("/dev/dm-0", "ext4"))
+	assert.Equal([]string{"blockdev", "dumpe2fs", "resize2fs"}, commands)
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package node
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/enix/san-iscsi-csi/pkg/common"
+	"k8s.io/klog"
+)
+
+const (
+	defaultPortalPort  = "3260"
+	portalProbeTimeout = 2 * time.Second
+)
+
+// Topology describes where the node stands, so that volumes are only scheduled on nodes able to reach them
+type Topology struct {
+	// Segments are reported as is
+	Segments map[string]string
+	// Arrays lists the portals of each array, arrays are reported if at least one of their portals is reachable
+	Arrays map[string][]string
+}
+
+// ParseTopology parses topology segments formatted as "name=value,name=value" and
+// arrays formatted as "name=portal,portal;name=portal"
+func ParseTopology(segments string, arrays string) (*Topology, error) {
+	topology := &Topology{
+		Segments: map[string]string{},
+		Arrays:   map[string][]string{},
+	}
+
+	for _, segment := range splitNonEmpty(segments, ",") {
+		parts := strings.SplitN(segment, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid topology segment %q, expected name=value", segment)
+		}
+		topology.Segments[parts[0]] = parts[1]
+	}
+
+	for _, array := range splitNonEmpty(arrays, ";") {
+		parts := strings.SplitN(array, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || len(splitNonEmpty(parts[1], ",")) == 0 {
+			return nil, fmt.Errorf("invalid topology array %q, expected name=portal,portal", array)
+		}
+		topology.Arrays[parts[0]] = splitNonEmpty(parts[1], ",")
+	}
+
+	return topology, nil
+}
+
+// getAccessibleTopology returns the topology segments of the node, probing array portals
+func (topology *Topology) getAccessibleTopology() *csi.Topology {
+	if topology == nil || (len(topology.Segments) == 0 && len(topology.Arrays) == 0) {
+		return nil
+	}
+
+	segments := map[string]string{}
+	for name, value := range topology.Segments {
+		segments[common.TopologyKey(name)] = value
+	}
+
+	for arrayName, portals := range topology.Arrays {
+		if isAnyPortalReachable(portals) {
+			klog.Infof("array %s is reachable from this node", arrayName)
+			segments[common.ArrayTopologyKey(arrayName)] = common.ArrayReachableTopologyValue
+		} else {
+			klog.Warningf("array %s is not reachable from this node, volumes it hosts will not be scheduled here", arrayName)
+		}
+	}
+
+	return &csi.Topology{Segments: segments}
+}
+
+func isAnyPortalReachable(portals []string) bool {
+	for _, portal := range portals {
+		if _, _, err := net.SplitHostPort(portal); err != nil {
+			portal = net.JoinHostPort(portal, defaultPortalPort)
+		}
+
+		connection, err := net.DialTimeout("tcp", portal, portalProbeTimeout)
+		if err != nil {
+			klog.V(2).Infof("portal %s is not reachable: %v", portal, err)
+			continue
+		}
+		connection.Close()
+		return true
+	}
+
+	return false
+}
+
+func splitNonEmpty(value string, separator string) []string {
+	parts := []string{}
+	for _, part := range strings.Split(value, separator) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
@@ -0,0 +1,26 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseTopology(t *testing.T) {
+	assert := assert.New(t)
+
+	topology, err := ParseTopology("site=paris, rack=r1", "msa1=10.0.0.1,10.0.0.2:3260;msa2=10.1.0.1")
+	assert.Nil(err)
+	assert.Equal(map[string]string{"site": "paris", "rack": "r1"}, topology.Segments)
+	assert.Equal(map[string][]string{"msa1": {"10.0.0.1", "10.0.0.2:3260"}, "msa2": {"10.1.0.1"}}, topology.Arrays)
+
+	topology, err = ParseTopology("", "")
+	assert.Nil(err)
+	assert.Nil(topology.getAccessibleTopology())
+
+	_, err = ParseTopology("site", "")
+	assert.Error(err)
+
+	_, err = ParseTopology("", "msa1=")
+	assert.Error(err)
+}
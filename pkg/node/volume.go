@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2021 Enix, SAS
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ *
+ * Authors:
+ * Paul Laffitte <paul.laffitte@enix.fr>
+ * Arthur Chaloin <arthur.chaloin@enix.fr>
+ * Alexandre Buisine <alexandre.buisine@enix.fr>
+ */
+
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// volumeInfo contains what the node needs to remember about a published volume
+// until it gets unpublished, as unpublish and expand requests do not carry it
+type volumeInfo struct {
+	Block          bool   `json:"block"`
+	ReservationKey string `json:"reservationKey,omitempty"`
+	TargetPath     string `json:"targetPath,omitempty"`
+}
+
+func (node *Node) getVolumeInfoPath(volumeID string) string {
+	return fmt.Sprintf("%s/volume-%s.json", node.runPath, volumeID)
+}
+
+func (node *Node) saveVolumeInfo(volumeID string, info *volumeInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(node.getVolumeInfoPath(volumeID), data, 0600)
+}
+
+// loadVolumeInfo returns default values for volumes published before this file was introduced
+func (node *Node) loadVolumeInfo(volumeID string) (*volumeInfo, error) {
+	info := &volumeInfo{}
+
+	data, err := ioutil.ReadFile(node.getVolumeInfoPath(volumeID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return info, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func (node *Node) deleteVolumeInfo(volumeID string) {
+	os.Remove(node.getVolumeInfoPath(volumeID))
+}